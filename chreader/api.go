@@ -2,7 +2,12 @@
 package chreader
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/Symantec/scotty/lib/yamlutil"
+	"io"
+	"net/http"
 	"time"
 )
 
@@ -14,29 +19,261 @@ type Entry struct {
 	Values map[string]float64
 }
 
+// MetaData describes the metrics CloudHealth returns for an asset.
+type MetaData struct {
+	// The type of asset like "aws:ec2:instance"
+	AssetType string
+	// How often CloudHealth has values like "hour" or "day"
+	Granularity string
+	// The names of the columns including "assetId" and "timestamp"
+	Keys []string
+}
+
+// Interval returns the time between entries that Granularity implies or
+// 0 if Granularity is not recognised.
+func (m *MetaData) Interval() time.Duration {
+	return m.interval()
+}
+
+// Metrics returns the metric names in Keys, that is every key except
+// "assetId" and "timestamp".
+func (m *MetaData) Metrics() []string {
+	return m.metrics()
+}
+
+// A Dataset represents the entries for one asset from the cloud health
+// server.
+type Dataset struct {
+	// The asset the entries are for. Empty if CloudHealth didn't say.
+	AssetId  string
+	MetaData MetaData
+	Entries  []*Entry
+}
+
 // CHResult represents a result from the cloud health server
 type CHResult struct {
-	Entries []*Entry // The returned entries
+	Entries []*Entry // The returned entries of all datasets
 	Next    string   // If non-empty, the URL to retrieve the rest
 
+	// The returned entries by asset. CH implementations that leave this
+	// empty must put all entries in Entries.
+	Datasets []*Dataset
+
 	// The cloud health server date like 'Mon, 2 Jan 2006 15:04:05 MST'
 	Date string
 }
 
+// APIError represents an error response from CloudHealth.
+type APIError struct {
+	// The HTTP status code e.g 404
+	Status int
+
+	// The error message from CloudHealth
+	Message string
+
+	// The requested URL with the API key redacted
+	URL string
+
+	// The cloud health server date like 'Mon, 2 Jan 2006 15:04:05 MST'
+	Date string
+
+	// The Retry-After header, if any
+	RetryAfter string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf(
+		"cloudhealth: %d %s: %s",
+		e.Status,
+		http.StatusText(e.Status),
+		e.Message)
+}
+
+// IsRateLimited returns true if err is an *APIError indicating that
+// CloudHealth is throttling requests.
+func IsRateLimited(err error) bool {
+	return hasStatus(err, http.StatusTooManyRequests)
+}
+
+// IsUnauthorized returns true if err is an *APIError indicating that
+// CloudHealth rejected the API key.
+func IsUnauthorized(err error) bool {
+	return hasStatus(err, http.StatusUnauthorized, http.StatusForbidden)
+}
+
+// IsNotFound returns true if err is an *APIError indicating that
+// CloudHealth could not find the requested asset.
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// HistoryError means that a read goes back further than CloudHealth's
+// named time ranges reach.
+type HistoryError struct {
+	// The start of the read
+	Start time.Time
+	// The oldest time within reach
+	Oldest time.Time
+}
+
+// IsHistoryOutOfReach returns true if err is a *HistoryError.
+func IsHistoryOutOfReach(err error) bool {
+	return isHistoryOutOfReach(err)
+}
+
 // CH is the interface for fetching one page of metrics from CloudHealth.
 // Most clients will not need to use this interface.
 type CH interface {
 	Fetch(url string) (result *CHResult, err error)
 }
 
+// ContextCH is implemented by CH instances that can abandon a fetch when
+// a context is done.
+type ContextCH interface {
+	CH
+	// FetchContext works like Fetch except that it gives up and returns
+	// ctx.Err() as soon as ctx is done.
+	FetchContext(ctx context.Context, url string) (result *CHResult, err error)
+}
+
+// FetchContext fetches url using ch. If ch implements ContextCH,
+// FetchContext passes ctx to it; otherwise FetchContext checks ctx only
+// before calling ch.Fetch.
+func FetchContext(ctx context.Context, ch CH, url string) (*CHResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cch, ok := ch.(ContextCH); ok {
+		return cch.FetchContext(ctx, url)
+	}
+	return ch.Fetch(url)
+}
+
 var (
-	// DefaultCH is the default implementation of CH.
-	DefaultCH CH = &chType{}
+	// DefaultCH is the default implementation of CH. It uses the default
+	// connect and read timeouts.
+	DefaultCH CH = mustNewCH(&Config{})
+)
+
+const (
+	kDefaultBaseUrl = "https://chapi.cloudhealthtech.com/metrics/v1"
 )
 
 // Config represents the configuration for a Reader.
 type Config struct {
 	ApiKey string `yaml:"apiKey"`
+
+	// Alternatives to ApiKey that keep the key out of the configuration.
+	// ApiKeyEnv names the environment variable holding the key.
+	// ApiKeyFile names the file holding the key. ApiKeyCommand is the
+	// command and its arguments that prints the key to standard output.
+	// Leading and trailing whitespace around the key is ignored. Set at
+	// most one of ApiKey, ApiKeyEnv, ApiKeyFile, and ApiKeyCommand.
+	ApiKeyEnv     string   `yaml:"apiKeyEnv"`
+	ApiKeyFile    string   `yaml:"apiKeyFile"`
+	ApiKeyCommand []string `yaml:"apiKeyCommand"`
+
+	// The URL of the CloudHealth metrics API. Empty means
+	// https://chapi.cloudhealthtech.com/metrics/v1
+	BaseUrl string `yaml:"baseUrl"`
+
+	// If set, the URL of the proxy to use for all requests to CloudHealth.
+	// Empty means use the proxy in the HTTPS_PROXY environment variable,
+	// if any.
+	ProxyUrl string `yaml:"proxyUrl"`
+
+	// If set, a PEM file of the certificate authorities to trust instead
+	// of the system ones when connecting to CloudHealth.
+	CaFile string `yaml:"caFile"`
+
+	// If set, PEM files of the client certificate and key to present to
+	// CloudHealth. Set both or neither.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// The maximum number of idle connections to CloudHealth to keep open.
+	// Zero means 10.
+	MaxIdleConns int `yaml:"maxIdleConns"`
+
+	// The maximum time to wait for a connection to CloudHealth.
+	// Zero means 30 seconds.
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+
+	// The maximum time to wait for one page of results from CloudHealth
+	// including reading the response body. Zero means 2 minutes.
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+
+	// The number of pages to fetch ahead of the one being read when a
+	// read spans several pages. The URLs of pages ahead are guessed from
+	// the page parameter of the next URL, and pages from wrong guesses
+	// or past the end of a read are thrown away. Zero means fetch one
+	// page at a time.
+	PageLookahead int `yaml:"pageLookahead"`
+
+	// The maximum number of times to start a read over because the UTC day
+	// changed on the CloudHealth servers in the middle of the read.
+	// Zero means 3.
+	MaxDayChangeRestarts int `yaml:"maxDayChangeRestarts"`
+
+	// The granularity of values to ask CloudHealth for: "minute", "hour",
+	// "day", or "week". Reads can ask for a different one with
+	// WithGranularity. Empty means CloudHealth's default.
+	Granularity string `yaml:"granularity"`
+
+	// If true, ask CloudHealth for explicit from and to times in windows
+	// of up to 31 days instead of for named time ranges like
+	// "last_7_days". Named time ranges reach back only 31 days.
+	ExplicitTimeRanges bool `yaml:"explicitTimeRanges"`
+
+	// If true, reads going back further than named time ranges reach
+	// return only the entries within reach instead of failing with a
+	// *HistoryError. Has no effect if ExplicitTimeRanges is true.
+	AllowPartialHistory bool `yaml:"allowPartialHistory"`
+
+	// How to retry failed requests to CloudHealth
+	Retry RetryPolicy `yaml:"retry"`
+
+	// The maximum sustained rate of requests to CloudHealth including
+	// retries and requests for subsequent pages. Zero means no limit.
+	RequestsPerSecond float64 `yaml:"requestsPerSecond"`
+
+	// How many requests may go to CloudHealth at once before the
+	// RequestsPerSecond limit kicks in. Zero means 1.
+	Burst int `yaml:"burst"`
+
+	// How to cache reads. Used by clients calling NewCachingReader.
+	Cache CachingOptions `yaml:"cache"`
+
+	// How to cache time ranges. Used by clients calling NewIntervalReader.
+	Intervals IntervalOptions `yaml:"intervals"`
+
+	// If set, the directory where NewReader saves data for days before
+	// the current UTC day so that it never has to fetch them again,
+	// even after a restart.
+	DiskCacheDir string `yaml:"diskCacheDir"`
+
+	// The maximum size of DiskCacheDir in bytes. When exceeded, the oldest
+	// days are removed first. Zero means 1GiB. Readers with the same
+	// DiskCacheDir share it and use the value of the newest reader.
+	DiskCacheMaxBytes int64 `yaml:"diskCacheMaxBytes"`
+
+	// How long after a UTC day ends CloudHealth takes to fill it in.
+	// Days are saved to DiskCacheDir only after this. Zero means 6 hours.
+	DiskCacheSettleTime time.Duration `yaml:"diskCacheSettleTime"`
+
+	// The maximum number of assets to ask CloudHealth for in one request
+	// when reading several assets at once. CloudHealth must accept a comma
+	// separated list of assets in the asset parameter for values above 1.
+	// Zero means 1.
+	MaxAssetsPerRequest int `yaml:"maxAssetsPerRequest"`
+
+	// The maximum number of requests to make at once when reading several
+	// assets at once. Zero means 8.
+	BatchParallelism int `yaml:"batchParallelism"`
+
+	// Other CloudHealth tenants to read from with their own API keys.
+	// Used by clients calling TenantConfig. NewReader ignores Tenants.
+	Tenants []Tenant `yaml:"tenants"`
 }
 
 func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -48,6 +285,154 @@ func (c *Config) Reset() {
 	*c = Config{}
 }
 
+// TenantConfig returns the configuration for reading from tenant t: c
+// with the API key of t instead of its own and without Tenants. If
+// c.DiskCacheDir is set, the returned configuration uses a directory next
+// to it with "-" and the name of t appended so that tenants don't share
+// one disk cache. Characters in the name that could change the path are
+// escaped.
+func (c *Config) TenantConfig(t *Tenant) Config {
+	return c.tenantConfig(t)
+}
+
+// Tenant represents a CloudHealth tenant with its own API key.
+type Tenant struct {
+	// The name of the tenant. Required. Only letters, digits, '.', '_', and
+	// '-' are allowed.
+	Name string `yaml:"name"`
+
+	// The AWS account numbers whose assets the tenant covers
+	AccountNumbers []string `yaml:"accountNumbers"`
+
+	// The API key of the tenant. These work the same way as the fields
+	// of the same name in Config.
+	ApiKey        string   `yaml:"apiKey"`
+	ApiKeyEnv     string   `yaml:"apiKeyEnv"`
+	ApiKeyFile    string   `yaml:"apiKeyFile"`
+	ApiKeyCommand []string `yaml:"apiKeyCommand"`
+}
+
+func (t *Tenant) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type tenantFields Tenant
+	if err := yamlutil.StrictUnmarshalYAML(
+		unmarshal, (*tenantFields)(t)); err != nil {
+		return err
+	}
+	return checkTenantName(t.Name)
+}
+
+// RetryPolicy controls how failed requests to CloudHealth are retried.
+// Only transient failures such as 5XX errors, 429 Too Many Requests,
+// timeouts, and dropped connections get retried. Between attempts, the
+// wait time doubles with some random jitter added. If CloudHealth sends a
+// Retry-After header, the wait is at least that long up to MaxRetryAfter.
+type RetryPolicy struct {
+	// The maximum number of attempts including the first one.
+	// Zero means 3; 1 means no retries.
+	MaxAttempts int `yaml:"maxAttempts"`
+
+	// The wait before the first retry. Zero means 500ms.
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+
+	// The maximum wait between retries. Zero means 30 seconds.
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+
+	// The maximum wait that a Retry-After header from CloudHealth can ask
+	// for. Longer waits are cut to this. Zero means 2 minutes.
+	MaxRetryAfter time.Duration `yaml:"maxRetryAfter"`
+}
+
+func (p *RetryPolicy) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type retryPolicyFields RetryPolicy
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*retryPolicyFields)(p))
+}
+
+// NewRetryingCH returns a CH that retries transient failures from ch
+// according to p. The returned CH implements ContextCH.
+func NewRetryingCH(ch CH, p RetryPolicy) CH {
+	return newRetryingCH(ch, p)
+}
+
+var (
+	// ErrMetaDataNotSupported is returned by ReadMetaData when the Reader
+	// does not implement MetaDataReader.
+	ErrMetaDataNotSupported = errors.New(
+		"chreader: Reader does not support metadata")
+
+	// ErrNoMetaData is returned by ReadMetaData when CloudHealth has no
+	// metadata for the asset for today or yesterday.
+	ErrNoMetaData = errors.New("chreader: No metadata for asset")
+)
+
+// MetaDataReader is implemented by Reader instances that can report the
+// metadata CloudHealth has for an asset.
+type MetaDataReader interface {
+	Reader
+	// ReadMetaData returns the metadata for assetId.
+	ReadMetaData(ctx context.Context, assetId string) (*MetaData, error)
+}
+
+// ReadMetaData returns the metadata for assetId using r. If r does not
+// implement MetaDataReader, ReadMetaData returns ErrMetaDataNotSupported.
+func ReadMetaData(ctx context.Context, r Reader, assetId string) (
+	*MetaData, error) {
+	return readMetaData(ctx, r, assetId)
+}
+
+// ReadMetrics returns the sorted names of the metrics CloudHealth has for
+// assetId using r. The names come from the metadata keys of assetId.
+// ReadMetrics returns no names if CloudHealth has no metadata for assetId
+// for today or yesterday. Clients that want the names cached pass a reader
+// from NewCachingReader.
+func ReadMetrics(ctx context.Context, r Reader, assetId string) (
+	[]string, error) {
+	return readMetrics(ctx, r, assetId)
+}
+
+// DayStore stores the entries of each asset for whole UTC days.
+// Implementations must be safe to use with multiple goroutines.
+type DayStore interface {
+	// Get returns the entries of assetId for the UTC day starting at day.
+	// ok is false if the day is not stored.
+	Get(assetId string, day time.Time) (entries []*Entry, ok bool)
+	// Put stores the entries of assetId for the UTC day starting at day.
+	Put(assetId string, day time.Time, entries []*Entry) error
+}
+
+// NewDiskDayStore returns a DayStore that keeps days in files under dir
+// creating dir if needed. It removes temporary files over an hour old.
+// When the files take more than maxBytes, the oldest days go first.
+// maxBytes of zero means 1GiB.
+func NewDiskDayStore(dir string, maxBytes int64) (DayStore, error) {
+	return newDiskDayStore(dir, maxBytes)
+}
+
+var (
+	// ErrTooManyDayChanges is returned when a read had to start over
+	// more than Config.MaxDayChangeRestarts times because the day on the
+	// CloudHealth servers kept changing. This usually means that
+	// CloudHealth or a proxy in between sends inconsistent Date headers.
+	ErrTooManyDayChanges = errors.New(
+		"chreader: Day on CloudHealth changed too many times during read")
+)
+
+// WithGranularity returns a copy of ctx that asks readers for values of
+// the given granularity: "minute", "hour", "day", or "week". Readers
+// created with NewReader use Config.Granularity for contexts without a
+// granularity. The readers in this package that cache entries, including
+// the disk cache of NewReader, keep entries of different granularities
+// apart whether the granularity comes from ctx or Config.Granularity.
+func WithGranularity(ctx context.Context, granularity string) context.Context {
+	return withGranularity(ctx, granularity)
+}
+
+// GranularityFromContext returns the granularity that ctx asks for or the
+// empty string if ctx doesn't ask for one.
+func GranularityFromContext(ctx context.Context) string {
+	return granularityOf(ctx)
+}
+
 // Reader is the interface for reading metrics from CloudHealth.
 type Reader interface {
 	// Read reads the metrics for a particular asset between start time
@@ -56,26 +441,303 @@ type Reader interface {
 	Read(assetId string, start, end time.Time) ([]*Entry, error)
 }
 
-// NewMemoizedReader returns a memoized version of r.
+// ContextReader is implemented by Reader instances that can abandon a read
+// when a context is done.
+type ContextReader interface {
+	Reader
+	// ReadContext works like Read except that it gives up and returns
+	// ctx.Err() as soon as ctx is done.
+	ReadContext(ctx context.Context, assetId string, start, end time.Time) (
+		[]*Entry, error)
+}
+
+// ReadContext reads using r. If r implements ContextReader, ReadContext
+// passes ctx to it; otherwise ReadContext checks ctx only before calling
+// r.Read.
+func ReadContext(
+	ctx context.Context, r Reader, assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cr, ok := r.(ContextReader); ok {
+		return cr.ReadContext(ctx, assetId, start, end)
+	}
+	return r.Read(assetId, start, end)
+}
+
+// IterReader is implemented by Reader instances that can hand over entries
+// as they read them instead of all at once. Only readers from NewReader and
+// NewCustomReader implement IterReader. The readers in this package that
+// cache or share reads need every entry of a read before handing any over,
+// so they don't implement IterReader even if the reader they wrap does.
+type IterReader interface {
+	Reader
+	// ReadIter calls visit with each entry for assetId between start time
+	// inclusive and end time exclusive in time order. ReadIter stops
+	// without error as soon as visit returns false. If ReadIter returns an
+	// error, visit may already have seen some of the entries.
+	ReadIter(
+		ctx context.Context,
+		assetId string,
+		start, end time.Time,
+		visit func(entry *Entry) bool) error
+}
+
+// ReadIter reads using r. If r implements IterReader, ReadIter passes ctx
+// and visit to it; otherwise ReadIter reads all the entries with
+// ReadContext and then calls visit with each one. In that case, ReadIter
+// holds every entry of the read in memory just like ReadContext.
+func ReadIter(
+	ctx context.Context,
+	r Reader,
+	assetId string,
+	start, end time.Time,
+	visit func(entry *Entry) bool) error {
+	return readIter(ctx, r, assetId, start, end, visit)
+}
+
+// BatchResult is the result of reading one asset of a batch.
+type BatchResult struct {
+	AssetId string
+	Entries []*Entry
+	// If non-nil, the error reading this asset. Entries is nil.
+	Err error
+}
+
+// BatchReader is implemented by Reader instances that can read several
+// assets at once.
+type BatchReader interface {
+	ContextReader
+	// ReadMany reads the metrics for each asset in assetIds between start
+	// time inclusive and end time exclusive. ReadMany returns one result
+	// for each asset in the same order as assetIds. An error reading one
+	// asset does not affect the results for the others.
+	ReadMany(assetIds []string, start, end time.Time) []*BatchResult
+	// ReadManyContext works like ReadMany except that it gives up and
+	// reports ctx.Err() for unread assets as soon as ctx is done.
+	ReadManyContext(
+		ctx context.Context, assetIds []string, start, end time.Time) []*BatchResult
+}
+
+// ReadMany reads several assets using r. If r implements BatchReader,
+// ReadMany passes ctx to it; otherwise ReadMany reads each asset separately
+// with up to 8 reads at once.
+func ReadMany(
+	ctx context.Context, r Reader, assetIds []string, start, end time.Time) []*BatchResult {
+	return readMany(ctx, r, assetIds, start, end)
+}
+
+// NewBatchReader returns a version of r that implements BatchReader by
+// reading each asset separately with up to parallelism reads at once.
+// parallelism of zero means 8. If r already implements BatchReader,
+// NewBatchReader returns r. The returned reader also implements
+// MetaDataReader.
+func NewBatchReader(r Reader, parallelism int) Reader {
+	return newBatchReader(r, parallelism)
+}
+
+// CachingOptions controls the size and expiration of a caching reader.
+type CachingOptions struct {
+	// The maximum number of cached reads. Zero means 1000.
+	MaxEntries int `yaml:"maxEntries"`
+
+	// The approximate maximum memory in bytes for cached reads.
+	// Zero means 256MiB.
+	MaxBytes int64 `yaml:"maxBytes"`
+
+	// How long reads that include the current UTC day stay cached.
+	// Zero means 1 minute.
+	TodayTTL time.Duration `yaml:"todayTTL"`
+
+	// How long reads of previous UTC days stay cached.
+	// Zero means until evicted.
+	PastTTL time.Duration `yaml:"pastTTL"`
+
+	// How long the metadata of an asset stays cached. Zero means 1 hour.
+	MetaDataTTL time.Duration `yaml:"metaDataTTL"`
+}
+
+func (o *CachingOptions) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type cachingOptionsFields CachingOptions
+	return yamlutil.StrictUnmarshalYAML(
+		unmarshal, (*cachingOptionsFields)(o))
+}
+
+// NewCachingReader returns a version of r that caches reads for
+// later calls with the same asset and time range. Unlike the reader
+// NewMemoizedReader returns, the returned reader is safe to use with
+// multiple goroutines and keeps its memory use bounded, so one instance
+// may serve all requests for the life of the process. The returned reader
+// implements ContextReader, MetaDataReader, and BatchReader. Batches read
+// only the uncached assets from r. Metadata is cached too.
+func NewCachingReader(r Reader, opts CachingOptions) Reader {
+	return newCachingReader(r, opts, time.Now)
+}
+
+// NewCustomCachingReader works like NewCachingReader but uses a custom
+// clock. now is the function returning the current time.
+func NewCustomCachingReader(
+	r Reader, opts CachingOptions, now func() time.Time) Reader {
+	return newCachingReader(r, opts, now)
+}
+
+// IntervalOptions controls a reader returned by NewIntervalReader.
+type IntervalOptions struct {
+	// The maximum number of assets to keep data for. Zero means 1000.
+	MaxAssets int `yaml:"maxAssets"`
+
+	// How long CloudHealth takes to have all data for a given time.
+	// Time ranges more recent than this are always fetched again.
+	// Zero means 1 hour.
+	SettleTime time.Duration `yaml:"settleTime"`
+
+	// How long to keep data. Zero means 32 days.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+func (o *IntervalOptions) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type intervalOptionsFields IntervalOptions
+	return yamlutil.StrictUnmarshalYAML(
+		unmarshal, (*intervalOptionsFields)(o))
+}
+
+// NewIntervalReader returns a version of r that remembers the entries it
+// reads for each asset along with the time ranges those entries cover.
+// The returned reader asks r only for the parts of a requested time range
+// it hasn't seen before and stitches the results together with what it
+// already has, so overlapping reads such as those from a sliding window
+// mostly come from memory. Returned entries are sorted by time with no two
+// having the same time. The returned reader is safe to use with multiple
+// goroutines and implements ContextReader, MetaDataReader, and
+// BatchReader.
+func NewIntervalReader(r Reader, opts IntervalOptions) Reader {
+	return newIntervalReader(r, opts, time.Now)
+}
+
+// NewCustomIntervalReader works like NewIntervalReader but uses a custom
+// clock. now is the function returning the current time.
+func NewCustomIntervalReader(
+	r Reader, opts IntervalOptions, now func() time.Time) Reader {
+	return newIntervalReader(r, opts, now)
+}
+
+// NewCoalescingReader returns a version of r that lets concurrent reads of
+// the same asset and time range share the result of a single read of r.
+// The returned reader is safe to use with multiple goroutines and
+// implements ContextReader, MetaDataReader, and BatchReader. Batches are
+// not coalesced.
+func NewCoalescingReader(r Reader) Reader {
+	return &coalescingReaderType{r: r}
+}
+
+// NewCoalescingCH returns a version of ch that lets concurrent fetches of
+// the same URL share the result of a single fetch of ch. The returned CH is
+// safe to use with multiple goroutines and implements ContextCH.
+func NewCoalescingCH(ch CH) CH {
+	return &coalescingCHType{ch: ch}
+}
+
+// NewMemoizedReader returns a memoized version of r. The returned reader
+// implements ContextReader and MetaDataReader.
 func NewMemoizedReader(r Reader) Reader {
 	return newMemoizedReader(r)
 }
 
-// NewReader creates a new reader
-func NewReader(c Config) Reader {
-	return &chReaderType{
-		config: c,
-		ch:     DefaultCH,
-		now:    time.Now,
+// NewRateLimitedCH returns a CH that limits calls to ch to
+// requestsPerSecond with bursts of up to burst calls. Callers over the
+// limit wait their turn. The returned CH implements ContextCH.
+func NewRateLimitedCH(ch CH, requestsPerSecond float64, burst int) CH {
+	return newRateLimitedCH(ch, requestsPerSecond, burst)
+}
+
+// NewRecordingCH returns a CH that fetches from ch and saves each result
+// in dir for a CH from NewReplayCH to serve later. Results are saved as
+// JSON files named after the hash of their URL with the API key redacted
+// and their number in the sequence of results for that URL, so that
+// sequences such as retries or the day changing get replayed as they
+// happened. Recording continues any sequences already in dir. Errors from
+// ch other than *APIError are returned without being saved. The returned
+// CH is safe to use with multiple goroutines and implements ContextCH.
+func NewRecordingCH(ch CH, dir string) (CH, error) {
+	result, err := newRecordingCH(ch, dir)
+	if err != nil {
+		return nil, err
 	}
+	return result, nil
+}
+
+// NewReplayCH returns a CH that serves the results that a CH from
+// NewRecordingCH saved in dir. Each fetch of a URL gets the next result
+// saved for it; once they run out, the returned CH keeps serving the
+// last one. The returned CH ignores the API key in requested URLs and
+// returns an error for URLs with no saved result. Next URLs in returned
+// results have the API key redacted. The returned CH is safe to use with
+// multiple goroutines.
+func NewReplayCH(dir string) CH {
+	return newReplayCH(dir)
+}
+
+// RegisterMetrics registers the tricorder metrics of this package under
+// /chreader.
+func RegisterMetrics() error {
+	return registerMetrics()
+}
+
+// NewReader creates a new reader that retries, rate limits, and coalesces
+// its requests according to c and keeps past days under c.DiskCacheDir if
+// set. The returned reader implements ContextReader, MetaDataReader,
+// BatchReader, and IterReader. NewReader reads the API key c names only
+// once. NewReader panics if c is not valid; see NewCheckedReader.
+func NewReader(c Config) Reader {
+	return mustNewReader(c)
+}
+
+// NewCheckedReader works like NewReader except that it returns an error
+// instead of panicking.
+func NewCheckedReader(c Config) (Reader, error) {
+	return newCheckedReader(c)
+}
+
+// NewReaderWithApiKey works like NewCheckedReader except that the
+// returned reader gets the API key from apiKey each time it makes a
+// request. apiKey must be safe to call from multiple goroutines.
+func NewReaderWithApiKey(c Config, apiKey func() string) (Reader, error) {
+	return newReader(c, apiKey)
+}
+
+// ReadApiKey reads an API key from r ignoring leading and trailing
+// whitespace. ReadApiKey returns an error if r has no key. Errors never
+// include the key.
+func ReadApiKey(r io.Reader) (string, error) {
+	return readApiKey(r)
 }
 
 // NewCustomReader creates a new reader that uses a custom implementation
 // of CH and a custom clock. now is the function returning the current time.
-// Clients pass time.Now for the system clock.
+// Clients pass time.Now for the system clock. The returned reader
+// implements ContextReader, MetaDataReader, BatchReader, and IterReader.
+// NewCustomReader ignores the settings in c for connecting to CloudHealth.
+// NewCustomReader panics if c.BaseUrl is not a valid URL.
 func NewCustomReader(c Config, ch CH, now func() time.Time) Reader {
 	return &chReaderType{
-		config: c,
-		ch:     ch,
-		now:    now}
+		config:  c,
+		baseUrl: mustParseBaseUrl(c.BaseUrl),
+		ch:      ch,
+		now:     now}
+}
+
+// NewCustomReaderWithDayStore works like NewCustomReader except that the
+// returned reader gets and saves the entries for days before the current
+// UTC day using store.
+func NewCustomReaderWithDayStore(
+	c Config, ch CH, now func() time.Time, store DayStore) Reader {
+	return &chReaderType{
+		config:  c,
+		baseUrl: mustParseBaseUrl(c.BaseUrl),
+		ch:      ch,
+		now:     now,
+		store:   store}
 }
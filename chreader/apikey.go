@@ -0,0 +1,146 @@
+package chreader
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// No API key is longer than this
+	kMaxApiKeyLength = 4096
+)
+
+var (
+	kTenantNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+var (
+	kErrNoApiKey      = errors.New("chreader: No API key")
+	kErrManyApiKeySet = errors.New(
+		"chreader: Set at most one of apiKey, apiKeyEnv, apiKeyFile, and apiKeyCommand")
+)
+
+// resolveApiKey returns the API key that c names. The errors that
+// resolveApiKey returns never include the key.
+func resolveApiKey(c *Config) (string, error) {
+	count := 0
+	for _, isSet := range []bool{
+		c.ApiKey != "",
+		c.ApiKeyEnv != "",
+		c.ApiKeyFile != "",
+		len(c.ApiKeyCommand) > 0} {
+		if isSet {
+			count++
+		}
+	}
+	if count > 1 {
+		return "", kErrManyApiKeySet
+	}
+	switch {
+	case c.ApiKeyEnv != "":
+		key, err := readApiKey(strings.NewReader(os.Getenv(c.ApiKeyEnv)))
+		if err != nil {
+			return "", fmt.Errorf("%v in $%s", err, c.ApiKeyEnv)
+		}
+		return key, nil
+	case c.ApiKeyFile != "":
+		return readApiKeyFile(c.ApiKeyFile)
+	case len(c.ApiKeyCommand) > 0:
+		return runApiKeyCommand(c.ApiKeyCommand)
+	}
+	return c.ApiKey, nil
+}
+
+func readApiKeyFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	key, err := readApiKey(f)
+	if err != nil {
+		return "", fmt.Errorf("%v in %s", err, path)
+	}
+	return key, nil
+}
+
+// runApiKeyCommand runs command and returns the key it prints. Standard
+// error of command is discarded as it could echo the key.
+func runApiKeyCommand(command []string) (string, error) {
+	output, err := exec.Command(command[0], command[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("chreader: %s: %v", command[0], err)
+	}
+	key, err := readApiKey(bytes.NewReader(output))
+	if err != nil {
+		return "", fmt.Errorf("%v from %s", err, command[0])
+	}
+	return key, nil
+}
+
+func readApiKey(r io.Reader) (string, error) {
+	content, err := ioutil.ReadAll(io.LimitReader(r, kMaxApiKeyLength+1))
+	if err != nil {
+		return "", err
+	}
+	if len(content) > kMaxApiKeyLength {
+		return "", errors.New("chreader: API key too long")
+	}
+	key := strings.TrimSpace(string(content))
+	if key == "" {
+		return "", kErrNoApiKey
+	}
+	return key, nil
+}
+
+func staticApiKey(key string) func() string {
+	return func() string {
+		return key
+	}
+}
+
+func (r *chReaderType) currentApiKey() string {
+	if r.apiKey != nil {
+		return r.apiKey()
+	}
+	return r.config.ApiKey
+}
+
+func (c *Config) tenantConfig(t *Tenant) Config {
+	result := *c
+	result.Tenants = nil
+	result.ApiKey = t.ApiKey
+	result.ApiKeyEnv = t.ApiKeyEnv
+	result.ApiKeyFile = t.ApiKeyFile
+	result.ApiKeyCommand = t.ApiKeyCommand
+	if result.DiskCacheDir != "" {
+		// Escaped in case t didn't come from YAML so that the name can't
+		// add elements to the path.
+		result.DiskCacheDir = filepath.Clean(
+			result.DiskCacheDir) + "-" + url.PathEscape(t.Name)
+	}
+	return result
+}
+
+// checkTenantName returns an error if name is empty or has characters
+// other than letters, digits, '.', '_', and '-'.
+func checkTenantName(name string) error {
+	if name == "" {
+		return errors.New("chreader: Tenants need a name")
+	}
+	if !kTenantNameRegex.MatchString(name) {
+		return fmt.Errorf(
+			"chreader: Tenant name '%s' may only have letters, digits, '.', '_', and '-'",
+			name)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package chreader_test
+
+import (
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiKey(t *testing.T) {
+	Convey("With page server", t, func() {
+		pageServer := &pageServerType{}
+		server := httptest.NewServer(pageServer)
+		defer server.Close()
+		dir, err := ioutil.TempDir("", "apikey")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		config := chreader.Config{BaseUrl: server.URL + "/metrics/v1"}
+		// sentApiKey reads with reader and returns the API key sent.
+		sentApiKey := func(reader chreader.Reader) string {
+			_, err := reader.Read(
+				kAssetId, time.Now().Add(-time.Minute), time.Now())
+			So(err, ShouldBeNil)
+			return pageServer.Urls[len(pageServer.Urls)-1].Query().Get("api_key")
+		}
+		Convey("From environment", func() {
+			os.Setenv("UHURA_TEST_API_KEY", " "+kApiKey+"\n")
+			defer os.Unsetenv("UHURA_TEST_API_KEY")
+			config.ApiKeyEnv = "UHURA_TEST_API_KEY"
+			reader, err := chreader.NewCheckedReader(config)
+			So(err, ShouldBeNil)
+			So(sentApiKey(reader), ShouldEqual, kApiKey)
+		})
+		Convey("Missing environment variable", func() {
+			config.ApiKeyEnv = "UHURA_TEST_NO_SUCH_VARIABLE"
+			_, err := chreader.NewCheckedReader(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("From file", func() {
+			config.ApiKeyFile = filepath.Join(dir, "apikey")
+			So(
+				ioutil.WriteFile(config.ApiKeyFile, []byte(kApiKey+"\n"), 0600),
+				ShouldBeNil)
+			reader, err := chreader.NewCheckedReader(config)
+			So(err, ShouldBeNil)
+			So(sentApiKey(reader), ShouldEqual, kApiKey)
+		})
+		Convey("Empty file", func() {
+			config.ApiKeyFile = filepath.Join(dir, "apikey")
+			So(ioutil.WriteFile(config.ApiKeyFile, []byte("\n"), 0600), ShouldBeNil)
+			_, err := chreader.NewCheckedReader(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("From command", func() {
+			config.ApiKeyCommand = []string{"echo", kApiKey}
+			reader, err := chreader.NewCheckedReader(config)
+			So(err, ShouldBeNil)
+			So(sentApiKey(reader), ShouldEqual, kApiKey)
+		})
+		Convey("Failing command hides its output", func() {
+			config.ApiKeyCommand = []string{
+				"sh", "-c", "echo secret; echo secret >&2; exit 1"}
+			_, err := chreader.NewCheckedReader(config)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "secret")
+		})
+		Convey("Only one source", func() {
+			config.ApiKey = kApiKey
+			config.ApiKeyEnv = "UHURA_TEST_API_KEY"
+			_, err := chreader.NewCheckedReader(config)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Key from function", func() {
+			apiKey := "first"
+			reader, err := chreader.NewReaderWithApiKey(
+				config,
+				func() string {
+					return apiKey
+				})
+			So(err, ShouldBeNil)
+			So(sentApiKey(reader), ShouldEqual, "first")
+			apiKey = "second"
+			So(sentApiKey(reader), ShouldEqual, "second")
+		})
+	})
+	Convey("ReadApiKey", t, func() {
+		key, err := chreader.ReadApiKey(strings.NewReader("\t" + kApiKey + " \n"))
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, kApiKey)
+		_, err = chreader.ReadApiKey(strings.NewReader(" \n"))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTenantConfig(t *testing.T) {
+	Convey("With tenants", t, func() {
+		config := chreader.Config{
+			ApiKey:       kApiKey,
+			BaseUrl:      "http://chapi.example.com/metrics/v1",
+			DiskCacheDir: "/var/cache/uhura/",
+			Tenants: []chreader.Tenant{
+				{
+					Name:           "payer2",
+					AccountNumbers: []string{"123456789012"},
+					ApiKeyEnv:      "PAYER2_API_KEY",
+				},
+			},
+		}
+		tenantConfig := config.TenantConfig(&config.Tenants[0])
+		Convey("Tenant API key replaces own", func() {
+			So(tenantConfig.ApiKey, ShouldBeEmpty)
+			So(tenantConfig.ApiKeyEnv, ShouldEqual, "PAYER2_API_KEY")
+			So(tenantConfig.Tenants, ShouldBeEmpty)
+		})
+		Convey("Other settings stay", func() {
+			So(tenantConfig.BaseUrl, ShouldEqual, config.BaseUrl)
+			So(config.Tenants, ShouldHaveLength, 1)
+		})
+		Convey("Tenants get their own disk cache", func() {
+			So(tenantConfig.DiskCacheDir, ShouldEqual, "/var/cache/uhura-payer2")
+		})
+		Convey("Tenant names can't leave the cache directory", func() {
+			for _, name := range []string{"../../etc", "a/b", "/"} {
+				tenantConfig := config.TenantConfig(&chreader.Tenant{Name: name})
+				So(
+					filepath.Dir(tenantConfig.DiskCacheDir),
+					ShouldEqual,
+					"/var/cache")
+				So(
+					filepath.Base(tenantConfig.DiskCacheDir),
+					ShouldStartWith,
+					"uhura-")
+			}
+		})
+	})
+}
@@ -0,0 +1,354 @@
+package chreader
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultBatchParallelism = 8
+)
+
+// batchAssetType holds what a multi-asset read has found so far for one
+// asset.
+type batchAssetType struct {
+	Entries     []*Entry
+	EarlyEnough bool // read an entry on or before the start time
+	LateEnough  bool // read an entry on or after the end time
+}
+
+type batchReaderType struct {
+	r           Reader
+	parallelism int
+}
+
+func newBatchReader(r Reader, parallelism int) Reader {
+	if _, ok := r.(BatchReader); ok {
+		return r
+	}
+	return &batchReaderType{r: r, parallelism: parallelism}
+}
+
+func (b *batchReaderType) Read(assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	return b.ReadContext(context.Background(), assetId, start, end)
+}
+
+func (b *batchReaderType) granularity(ctx context.Context) string {
+	return granularityFor(ctx, b.r)
+}
+
+func (b *batchReaderType) ReadMetaData(
+	ctx context.Context, assetId string) (*MetaData, error) {
+	return readMetaData(ctx, b.r, assetId)
+}
+
+func (b *batchReaderType) ReadContext(
+	ctx context.Context, assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	return ReadContext(ctx, b.r, assetId, start, end)
+}
+
+func (b *batchReaderType) ReadMany(
+	assetIds []string, start, end time.Time) []*BatchResult {
+	return b.ReadManyContext(context.Background(), assetIds, start, end)
+}
+
+func (b *batchReaderType) ReadManyContext(
+	ctx context.Context, assetIds []string, start, end time.Time) []*BatchResult {
+	return readEach(ctx, b.r, assetIds, start, end, b.parallelism)
+}
+
+func readMany(
+	ctx context.Context, r Reader, assetIds []string, start, end time.Time) []*BatchResult {
+	if br, ok := r.(BatchReader); ok {
+		return br.ReadManyContext(ctx, assetIds, start, end)
+	}
+	return readEach(ctx, r, assetIds, start, end, 0)
+}
+
+// readEach reads each asset in assetIds separately using r with at most
+// parallelism reads at once. parallelism of zero means 8.
+func readEach(
+	ctx context.Context,
+	r Reader,
+	assetIds []string,
+	start, end time.Time,
+	parallelism int) []*BatchResult {
+	results := make([]*BatchResult, len(assetIds))
+	fanOut(len(assetIds), parallelism, func(i int) {
+		entries, err := ReadContext(ctx, r, assetIds[i], start, end)
+		results[i] = &BatchResult{
+			AssetId: assetIds[i], Entries: entries, Err: err}
+	})
+	return results
+}
+
+// fanOut calls fn(0), fn(1), ... fn(n-1) with at most parallelism calls
+// running at once and returns when all calls are done. parallelism of zero
+// means 8.
+func fanOut(n, parallelism int, fn func(i int)) {
+	if parallelism <= 0 {
+		parallelism = kDefaultBatchParallelism
+	}
+	if parallelism > n {
+		parallelism = n
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+func (r *chReaderType) ReadMany(
+	assetIds []string, start, end time.Time) []*BatchResult {
+	return r.ReadManyContext(context.Background(), assetIds, start, end)
+}
+
+// ReadManyContext asks CloudHealth for up to r.config.MaxAssetsPerRequest
+// assets at a time. When a DayStore is in use, it reads each asset
+// separately so that past days still come from the store.
+func (r *chReaderType) ReadManyContext(
+	ctx context.Context, assetIds []string, start, end time.Time) []*BatchResult {
+	chunkSize := r.config.MaxAssetsPerRequest
+	if chunkSize <= 1 || r.store != nil {
+		return readEach(
+			ctx, r, assetIds, start, end, r.config.BatchParallelism)
+	}
+	results := make([]*BatchResult, len(assetIds))
+	chunkCount := (len(assetIds) + chunkSize - 1) / chunkSize
+	fanOut(chunkCount, r.config.BatchParallelism, func(i int) {
+		chunkStart := i * chunkSize
+		chunkEnd := chunkStart + chunkSize
+		if chunkEnd > len(assetIds) {
+			chunkEnd = len(assetIds)
+		}
+		r.readChunk(
+			ctx,
+			assetIds[chunkStart:chunkEnd],
+			start,
+			end,
+			results[chunkStart:chunkEnd])
+	})
+	return results
+}
+
+// readChunk reads assetIds with a single multi-asset query and stores
+// the result for each asset in results. If CloudHealth rejects the query,
+// readChunk reads each asset separately instead.
+func (r *chReaderType) readChunk(
+	ctx context.Context,
+	assetIds []string,
+	start, end time.Time,
+	results []*BatchResult) {
+	var entryLists [][]*Entry
+	var err error
+	if len(assetIds) > 1 {
+		err = r.restartOnDayChange(func() error {
+			var err error
+			entryLists, err = r.readManyAssets(ctx, assetIds, start, end)
+			return err
+		})
+	}
+	if len(assetIds) == 1 || isBatchRejected(err) {
+		for i, assetId := range assetIds {
+			entries, err := r.ReadContext(ctx, assetId, start, end)
+			results[i] = &BatchResult{
+				AssetId: assetId, Entries: entries, Err: err}
+		}
+		return
+	}
+	for i, assetId := range assetIds {
+		results[i] = &BatchResult{AssetId: assetId, Err: err}
+		if err == nil {
+			results[i].Entries = entryLists[i]
+		}
+	}
+}
+
+// readManyAssets works like read but for several assets at once.
+// Because a page may hold entries for any of the assets, readManyAssets
+// can't stop early the way readRange does. Instead it fetches the longer
+// time range up front in case of clock skew and fetches "today" or
+// "yesterday" only if some asset needs it. Entries go only to the asset
+// their dataset is for, so assets without a dataset get no entries.
+func (r *chReaderType) readManyAssets(
+	ctx context.Context, assetIds []string, start, end time.Time) (
+	[][]*Entry, error) {
+	if err := checkGranularity(r.granularity(ctx)); err != nil {
+		return nil, err
+	}
+	now := r.now().UTC()
+	start = start.UTC()
+	end = end.UTC()
+	midnight := midnightOf(now)
+	var lastBatchTime time.Time // zero value means no value
+	assets := make([]batchAssetType, len(assetIds))
+	joinedIds := strings.Join(assetIds, ",")
+	if !r.config.ExplicitTimeRanges {
+		if err := r.checkHistory(start, midnight); err != nil {
+			return nil, err
+		}
+	}
+	if r.config.ExplicitTimeRanges {
+		for _, window := range planWindows(start, end) {
+			if err := r.getManyEntries(
+				ctx,
+				assetIds,
+				r.computeExplicitUrlStr(ctx, joinedIds, window),
+				window.Start,
+				window.End,
+				&lastBatchTime,
+				assets); err != nil {
+				return nil, err
+			}
+		}
+	} else if start.Before(midnight) {
+		timeRangeIdx := computeTimeRangeIdx(midnight.Sub(start))
+		if err := r.getManyEntries(
+			ctx,
+			assetIds,
+			r.computeUrlStr(ctx, joinedIds, previousTimeRange(timeRangeIdx)),
+			start,
+			end,
+			&lastBatchTime,
+			assets); err != nil {
+			return nil, err
+		}
+		if !allAssets(assets, func(a *batchAssetType) bool {
+			return a.LateEnough
+		}) {
+			if err := r.getManyEntries(
+				ctx,
+				assetIds,
+				r.computeUrlStr(ctx, joinedIds, "today"),
+				start,
+				end,
+				&lastBatchTime,
+				assets); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if err := r.getManyEntries(
+			ctx,
+			assetIds,
+			r.computeUrlStr(ctx, joinedIds, "today"),
+			start,
+			end,
+			&lastBatchTime,
+			assets); err != nil {
+			return nil, err
+		}
+		if !allAssets(assets, func(a *batchAssetType) bool {
+			return a.EarlyEnough
+		}) {
+			if err := r.getManyEntries(
+				ctx,
+				assetIds,
+				r.computeUrlStr(ctx, joinedIds, "yesterday"),
+				start,
+				end,
+				&lastBatchTime,
+				assets); err != nil {
+				return nil, err
+			}
+			// Like readRange, re-get today's entries if we still don't
+			// have entries past the end time.
+			if !allAssets(assets, func(a *batchAssetType) bool {
+				return a.LateEnough
+			}) {
+				if err := r.getManyEntries(
+					ctx,
+					assetIds,
+					r.computeUrlStr(ctx, joinedIds, "today"),
+					start,
+					end,
+					&lastBatchTime,
+					assets); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	result := make([][]*Entry, len(assets))
+	for i := range assets {
+		// Pages from different time ranges may overlap with clock skew.
+		result[i] = combineEntries(assets[i].Entries)
+	}
+	return result, nil
+}
+
+// getManyEntries fetches all pages starting at url for assetIds and adds
+// the entries between start and end to assets.
+func (r *chReaderType) getManyEntries(
+	ctx context.Context,
+	assetIds []string,
+	url string,
+	start, end time.Time,
+	lastBatchTime *time.Time,
+	assets []batchAssetType) error {
+	pager := newPager(ctx, r.ch, url, r.config.PageLookahead)
+	defer pager.Close()
+	for {
+		chResult, err := pager.Next()
+		if chResult == nil || err != nil {
+			return err
+		}
+		if err := checkBatchTime(chResult, lastBatchTime); err != nil {
+			return err
+		}
+		for i, assetId := range assetIds {
+			batchEntries := combineEntries(
+				entriesOfDatasets(matchingDatasets(chResult, assetId))...)
+			if len(batchEntries) > 0 && !batchEntries[0].Time.After(start) {
+				assets[i].EarlyEnough = true
+			}
+			startIdx, endIdx := findRange(batchEntries, start, end)
+			assets[i].Entries = append(
+				assets[i].Entries, batchEntries[startIdx:endIdx]...)
+			if endIdx < len(batchEntries) {
+				assets[i].LateEnough = true
+			}
+		}
+	}
+}
+
+func allAssets(assets []batchAssetType, f func(a *batchAssetType) bool) bool {
+	for i := range assets {
+		if !f(&assets[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isBatchRejected returns true if err means that CloudHealth would not
+// accept a query for several assets at once as opposed to being
+// unavailable or rejecting the API key.
+func isBatchRejected(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Status >= http.StatusBadRequest &&
+		apiErr.Status < http.StatusInternalServerError &&
+		!IsRateLimited(err) &&
+		!IsUnauthorized(err)
+}
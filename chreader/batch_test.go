@@ -0,0 +1,339 @@
+package chreader_test
+
+import (
+	"context"
+	"errors"
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// multiAssetCHType is a fake CH that accepts several comma separated
+// assets and returns a dataset for each one. Entries come every hour on the
+// hour with a value named after the asset.
+type multiAssetCHType struct {
+	CurrentTime time.Time
+	// Assets CloudHealth knows about
+	Known map[string]bool
+	// Assets CloudHealth knows about but returns no dataset for
+	NoData map[string]bool
+	// If true, datasets don't say what asset they are for
+	Unlabeled bool
+	// If true, queries for more than one asset fail with 400
+	RejectMany bool
+
+	mu        sync.Mutex
+	callCount int
+}
+
+func (ch *multiAssetCHType) Fetch(rawUrl string) (*chreader.CHResult, error) {
+	ch.mu.Lock()
+	ch.callCount++
+	ch.mu.Unlock()
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	values := u.Query()
+	assetIds := strings.Split(values.Get("asset"), ",")
+	if ch.RejectMany && len(assetIds) > 1 {
+		return nil, &chreader.APIError{Status: http.StatusBadRequest}
+	}
+	midnight := ch.CurrentTime.UTC().Truncate(24 * time.Hour)
+	start, end := midnight, ch.CurrentTime
+	if timeRange := values.Get("time_range"); timeRange != "today" {
+		start, end = midnight.Add(kTimeRangeValues[timeRange]), midnight
+	}
+	var result chreader.CHResult
+	for _, assetId := range assetIds {
+		if !ch.Known[assetId] {
+			return nil, &chreader.APIError{Status: http.StatusNotFound}
+		}
+		if ch.NoData[assetId] {
+			continue
+		}
+		dataset := &chreader.Dataset{AssetId: assetId}
+		if ch.Unlabeled {
+			dataset.AssetId = ""
+		}
+		for _, entry := range entriesFromTo(start, end) {
+			entry.Values = map[string]float64{"cpu:" + assetId: 1.0}
+			dataset.Entries = append(dataset.Entries, entry)
+		}
+		result.Datasets = append(result.Datasets, dataset)
+		result.Entries = append(result.Entries, dataset.Entries...)
+	}
+	result.Date = ch.CurrentTime.Format("Mon, 2 Jan 2006 15:04:05 GMT")
+	return &result, nil
+}
+
+func (ch *multiAssetCHType) CallCount() int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.callCount
+}
+
+// shouldBeForAsset checks that each entry has only the value of the asset
+// given as the expected argument.
+func shouldBeForAsset(actual interface{}, expected ...interface{}) string {
+	for _, entry := range actual.([]*chreader.Entry) {
+		if _, ok := entry.Values["cpu:"+expected[0].(string)]; !ok ||
+			len(entry.Values) != 1 {
+			return "Expected only values of " + expected[0].(string)
+		}
+	}
+	return ""
+}
+
+// parallelReaderType is a Reader that records the most reads running at
+// once. It fails reads of "bad".
+type parallelReaderType struct {
+	mu        sync.Mutex
+	running   int
+	MaxActive int
+}
+
+func (r *parallelReaderType) Read(assetId string, start, end time.Time) (
+	[]*chreader.Entry, error) {
+	r.mu.Lock()
+	r.running++
+	if r.running > r.MaxActive {
+		r.MaxActive = r.running
+	}
+	r.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	r.mu.Lock()
+	r.running--
+	r.mu.Unlock()
+	if assetId == "bad" {
+		return nil, errors.New("bad asset")
+	}
+	return []*chreader.Entry{{Time: start}}, nil
+}
+
+func TestReadMany(t *testing.T) {
+	Convey("With fake multi-asset cloudhealth", t, func() {
+		fakeCh := &multiAssetCHType{
+			CurrentTime: kNow,
+			Known: map[string]bool{
+				"a": true, "b": true, "c": true, "nodata": true},
+			NoData: map[string]bool{"nodata": true},
+		}
+		newReader := func(maxAssetsPerRequest int) chreader.Reader {
+			return chreader.NewCustomReader(
+				chreader.Config{
+					ApiKey:              kApiKey,
+					MaxAssetsPerRequest: maxAssetsPerRequest,
+				},
+				fakeCh,
+				func() time.Time {
+					return kNow
+				})
+		}
+		start := kMidnight.Add(-4 * time.Hour)
+		end := kMidnight.Add(3 * time.Hour)
+		Convey("Assets read together", func() {
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(2),
+				[]string{"a", "b", "c"},
+				start,
+				end)
+			So(results, ShouldHaveLength, 3)
+			for i, assetId := range []string{"a", "b", "c"} {
+				So(results[i].AssetId, ShouldEqual, assetId)
+				So(results[i].Err, ShouldBeNil)
+				So(results[i].Entries, shouldHaveRange, start, end)
+				So(results[i].Entries, shouldBeForAsset, assetId)
+			}
+			// "last_2_days" and "today" for a and b; "yesterday" and
+			// "today" for c
+			So(fakeCh.CallCount(), ShouldEqual, 4)
+		})
+		Convey("One asset per request by default", func() {
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(0),
+				[]string{"a", "b", "c"},
+				start,
+				end)
+			for i, assetId := range []string{"a", "b", "c"} {
+				So(results[i].Entries, shouldHaveRange, start, end)
+				So(results[i].Entries, shouldBeForAsset, assetId)
+			}
+			So(fakeCh.CallCount(), ShouldEqual, 6)
+		})
+		Convey("Unknown assets fail alone", func() {
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(10),
+				[]string{"a", "unknown", "b"},
+				start,
+				end)
+			So(results[0].Entries, shouldHaveRange, start, end)
+			So(chreader.IsNotFound(results[1].Err), ShouldBeTrue)
+			So(results[1].Entries, ShouldBeNil)
+			So(results[2].Entries, shouldHaveRange, start, end)
+			So(results[2].Entries, shouldBeForAsset, "b")
+		})
+		Convey("Assets without datasets get no entries", func() {
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(10),
+				[]string{"nodata", "b"},
+				start,
+				end)
+			So(results[0].Err, ShouldBeNil)
+			So(results[0].Entries, ShouldBeEmpty)
+			So(results[1].Entries, shouldHaveRange, start, end)
+			So(results[1].Entries, shouldBeForAsset, "b")
+		})
+		Convey("Datasets without asset go to no asset", func() {
+			fakeCh.Unlabeled = true
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(10),
+				[]string{"nodata", "b"},
+				start,
+				end)
+			So(results[0].Err, ShouldBeNil)
+			So(results[0].Entries, ShouldBeEmpty)
+			So(results[1].Err, ShouldBeNil)
+			So(results[1].Entries, ShouldBeEmpty)
+		})
+		Convey("Today fetched again after yesterday like single reads", func() {
+			// CloudHealth a day ahead of us
+			fakeCh.CurrentTime = kMidnight.Add(24*time.Hour + 30*time.Minute)
+			skewedStart := kMidnight.Add(time.Hour)
+			skewedEnd := kMidnight.Add(48 * time.Hour)
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(10),
+				[]string{"a", "b"},
+				skewedStart,
+				skewedEnd)
+			for i, assetId := range []string{"a", "b"} {
+				So(results[i].Err, ShouldBeNil)
+				So(
+					results[i].Entries,
+					shouldHaveRange,
+					skewedStart,
+					kMidnight.Add(25*time.Hour))
+				So(results[i].Entries, shouldBeForAsset, assetId)
+			}
+			// "today", "yesterday", and "today" again
+			So(fakeCh.CallCount(), ShouldEqual, 3)
+			// Same as reading one asset
+			_, err := newReader(1).Read("a", skewedStart, skewedEnd)
+			So(err, ShouldBeNil)
+			So(fakeCh.CallCount(), ShouldEqual, 6)
+		})
+		Convey("Rejected batches read one asset at a time", func() {
+			fakeCh.RejectMany = true
+			results := chreader.ReadMany(
+				context.Background(),
+				newReader(10),
+				[]string{"a", "b"},
+				kMidnight.Add(time.Hour),
+				kMidnight.Add(3*time.Hour))
+			for i, assetId := range []string{"a", "b"} {
+				So(results[i].Err, ShouldBeNil)
+				So(
+					results[i].Entries,
+					shouldHaveRange,
+					kMidnight.Add(time.Hour),
+					kMidnight.Add(3*time.Hour))
+				So(results[i].Entries, shouldBeForAsset, assetId)
+			}
+			// The rejected batch plus "today" for each asset
+			So(fakeCh.CallCount(), ShouldEqual, 3)
+		})
+		Convey("Caching reader reads only uncached assets", func() {
+			reader := chreader.NewCustomCachingReader(
+				newReader(10),
+				chreader.CachingOptions{},
+				func() time.Time {
+					return kNow
+				})
+			chreader.ReadMany(
+				context.Background(), reader, []string{"a", "b"}, start, end)
+			So(fakeCh.CallCount(), ShouldEqual, 2)
+			results := chreader.ReadMany(
+				context.Background(),
+				reader,
+				[]string{"a", "b", "c"},
+				start,
+				end)
+			for i, assetId := range []string{"a", "b", "c"} {
+				So(results[i].Entries, shouldHaveRange, start, end)
+				So(results[i].Entries, shouldBeForAsset, assetId)
+			}
+			// Just "yesterday" and "today" for c
+			So(fakeCh.CallCount(), ShouldEqual, 4)
+		})
+		Convey("Interval reader batches missing time ranges", func() {
+			reader := chreader.NewCustomIntervalReader(
+				newReader(10),
+				chreader.IntervalOptions{},
+				func() time.Time {
+					return kNow
+				})
+			chreader.ReadMany(
+				context.Background(),
+				reader,
+				[]string{"a", "b"},
+				start,
+				kMidnight)
+			// "last_2_days" and "today" as nothing came after midnight
+			So(fakeCh.CallCount(), ShouldEqual, 2)
+			results := chreader.ReadMany(
+				context.Background(), reader, []string{"a", "b"}, start, end)
+			for i, assetId := range []string{"a", "b"} {
+				So(results[i].Entries, shouldHaveRange, start, end)
+				So(results[i].Entries, shouldBeForAsset, assetId)
+			}
+			// Just "today" for both
+			So(fakeCh.CallCount(), ShouldEqual, 3)
+		})
+		Convey("Interval reader keeps assets evicted mid read", func() {
+			reader := chreader.NewCustomIntervalReader(
+				newReader(10),
+				chreader.IntervalOptions{MaxAssets: 2},
+				func() time.Time {
+					return kNow
+				})
+			for _, assetIds := range [][]string{
+				{"a"}, {"b", "c", "a"}, {"a", "b", "c"}} {
+				results := chreader.ReadMany(
+					context.Background(), reader, assetIds, start, end)
+				for i, assetId := range assetIds {
+					So(results[i].Err, ShouldBeNil)
+					So(results[i].Entries, shouldHaveRange, start, end)
+					So(results[i].Entries, shouldBeForAsset, assetId)
+				}
+			}
+		})
+	})
+	Convey("With plain reader", t, func() {
+		plainReader := &parallelReaderType{}
+		reader := chreader.NewBatchReader(plainReader, 2)
+		Convey("Fan out is bounded", func() {
+			results := reader.(chreader.BatchReader).ReadMany(
+				[]string{"a", "b", "bad", "c", "d", "e"}, kMidnight, kNow)
+			So(results, ShouldHaveLength, 6)
+			So(plainReader.MaxActive, ShouldEqual, 2)
+			So(results[0].Entries, ShouldHaveLength, 1)
+			So(results[2].Err, ShouldNotBeNil)
+			So(results[5].AssetId, ShouldEqual, "e")
+			So(results[5].Err, ShouldBeNil)
+		})
+		Convey("Batch readers returned as is", func() {
+			So(chreader.NewBatchReader(reader, 4), ShouldEqual, reader)
+		})
+	})
+}
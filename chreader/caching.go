@@ -0,0 +1,292 @@
+package chreader
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultMaxCachedReads = 1000
+	kDefaultMaxCachedBytes = 256 * 1024 * 1024
+	kDefaultTodayTTL       = time.Minute
+	kDefaultMetaDataTTL    = time.Hour
+)
+
+// Rough memory overheads for estimating the size of cached entries
+const (
+	kEntryOverhead = 96
+	kValueOverhead = 32
+)
+
+type cachedReadType struct {
+	Key     memoizedReaderKeyType
+	Entries []*Entry
+	Size    int64
+	Expires time.Time // zero value means never
+}
+
+type cachedMetaDataType struct {
+	MetaData *MetaData
+	Expires  time.Time
+}
+
+type cachingReaderType struct {
+	r          Reader
+	now        func() time.Time
+	maxEntries int
+	maxBytes   int64
+	todayTTL   time.Duration
+	pastTTL    time.Duration
+	metaTTL    time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // Most recently used at front
+	byKey   map[memoizedReaderKeyType]*list.Element
+	byteCnt int64
+	// By asset with granularity. Holds at most maxEntries.
+	metaData map[string]*cachedMetaDataType
+}
+
+func newCachingReader(
+	r Reader, opts CachingOptions, now func() time.Time) *cachingReaderType {
+	result := &cachingReaderType{
+		r:          r,
+		now:        now,
+		maxEntries: opts.MaxEntries,
+		maxBytes:   opts.MaxBytes,
+		todayTTL:   opts.TodayTTL,
+		pastTTL:    opts.PastTTL,
+		metaTTL:    opts.MetaDataTTL,
+		lru:        list.New(),
+		byKey:      make(map[memoizedReaderKeyType]*list.Element),
+		metaData:   make(map[string]*cachedMetaDataType),
+	}
+	if result.maxEntries <= 0 {
+		result.maxEntries = kDefaultMaxCachedReads
+	}
+	if result.maxBytes <= 0 {
+		result.maxBytes = kDefaultMaxCachedBytes
+	}
+	if result.todayTTL <= 0 {
+		result.todayTTL = kDefaultTodayTTL
+	}
+	if result.metaTTL <= 0 {
+		result.metaTTL = kDefaultMetaDataTTL
+	}
+	return result
+}
+
+func (c *cachingReaderType) Read(assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	return c.ReadContext(context.Background(), assetId, start, end)
+}
+
+func (c *cachingReaderType) granularity(ctx context.Context) string {
+	return granularityFor(ctx, c.r)
+}
+
+func (c *cachingReaderType) ReadMetaData(
+	ctx context.Context, assetId string) (*MetaData, error) {
+	key := granularityKey(c.granularity(ctx), assetId)
+	result, ok := c.getMetaData(key)
+	if !ok {
+		var err error
+		result, err = readMetaData(ctx, c.r, assetId)
+		if err != nil {
+			return nil, err
+		}
+		c.putMetaData(key, result)
+	}
+	// Return defensive copy to protect cache
+	resultCopy := *result
+	resultCopy.Keys = make([]string, len(result.Keys))
+	copy(resultCopy.Keys, result.Keys)
+	return &resultCopy, nil
+}
+
+func (c *cachingReaderType) ReadContext(
+	ctx context.Context, assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	// Convert to UTC to ensure cache keys match
+	start = start.UTC()
+	end = end.UTC()
+	key := memoizedReaderKeyType{
+		AssetId:     assetId,
+		Granularity: c.granularity(ctx),
+		Start:       start,
+		End:         end}
+	result, ok := c.get(key)
+	if !ok {
+		var err error
+		result, err = ReadContext(ctx, c.r, assetId, start, end)
+		if err != nil {
+			return nil, err
+		}
+		c.put(key, result)
+	}
+	// Return defensive copy to protect cache
+	resultCopy := make([]*Entry, len(result))
+	copy(resultCopy, result)
+	return resultCopy, nil
+}
+
+func (c *cachingReaderType) ReadMany(
+	assetIds []string, start, end time.Time) []*BatchResult {
+	return c.ReadManyContext(context.Background(), assetIds, start, end)
+}
+
+// ReadManyContext reads only the assets not already cached from c.r
+// using a single batch.
+func (c *cachingReaderType) ReadManyContext(
+	ctx context.Context, assetIds []string, start, end time.Time) []*BatchResult {
+	start = start.UTC()
+	end = end.UTC()
+	results := make([]*BatchResult, len(assetIds))
+	var missIdxs []int
+	var missIds []string
+	for i, assetId := range assetIds {
+		entries, ok := c.get(memoizedReaderKeyType{
+			AssetId:     assetId,
+			Granularity: c.granularity(ctx),
+			Start:       start,
+			End:         end})
+		if !ok {
+			missIdxs = append(missIdxs, i)
+			missIds = append(missIds, assetId)
+			continue
+		}
+		// Return defensive copy to protect cache
+		entriesCopy := make([]*Entry, len(entries))
+		copy(entriesCopy, entries)
+		results[i] = &BatchResult{AssetId: assetId, Entries: entriesCopy}
+	}
+	if len(missIds) == 0 {
+		return results
+	}
+	for i, result := range readMany(ctx, c.r, missIds, start, end) {
+		if result.Err == nil {
+			c.put(memoizedReaderKeyType{
+				AssetId:     result.AssetId,
+				Granularity: c.granularity(ctx),
+				Start:       start,
+				End:         end}, result.Entries)
+			entriesCopy := make([]*Entry, len(result.Entries))
+			copy(entriesCopy, result.Entries)
+			result = &BatchResult{
+				AssetId: result.AssetId, Entries: entriesCopy}
+		}
+		results[missIdxs[i]] = result
+	}
+	return results
+}
+
+func (c *cachingReaderType) get(key memoizedReaderKeyType) (
+	[]*Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.byKey[key]
+	if !ok {
+		return nil, false
+	}
+	cached := elem.Value.(*cachedReadType)
+	if !cached.Expires.IsZero() && !c.now().Before(cached.Expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return cached.Entries, true
+}
+
+func (c *cachingReaderType) put(key memoizedReaderKeyType, entries []*Entry) {
+	now := c.now()
+	cached := &cachedReadType{
+		Key:     key,
+		Entries: entries,
+		Size:    entriesSize(entries),
+	}
+	if cached.Size > c.maxBytes {
+		return
+	}
+	// Data for days before today never changes
+	if key.End.After(midnightOf(now)) {
+		cached.Expires = now.Add(c.todayTTL)
+	} else if c.pastTTL > 0 {
+		cached.Expires = now.Add(c.pastTTL)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.byKey[key]; ok {
+		c.remove(elem)
+	}
+	c.byKey[key] = c.lru.PushFront(cached)
+	c.byteCnt += cached.Size
+	for c.lru.Len() > c.maxEntries || c.byteCnt > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *cachingReaderType) getMetaData(key string) (*MetaData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.metaData[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(cached.Expires) {
+		delete(c.metaData, key)
+		return nil, false
+	}
+	return cached.MetaData, true
+}
+
+func (c *cachingReaderType) putMetaData(key string, metaData *MetaData) {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.metaData[key]; !ok && len(c.metaData) >= c.maxEntries {
+		// Make room by dropping expired metadata or, failing that, any
+		// one asset.
+		for oldKey, cached := range c.metaData {
+			if !now.Before(cached.Expires) {
+				delete(c.metaData, oldKey)
+			}
+		}
+		for oldKey := range c.metaData {
+			if len(c.metaData) < c.maxEntries {
+				break
+			}
+			delete(c.metaData, oldKey)
+		}
+	}
+	c.metaData[key] = &cachedMetaDataType{
+		MetaData: metaData,
+		Expires:  now.Add(c.metaTTL),
+	}
+}
+
+// remove removes elem from the cache. Caller must hold the lock.
+func (c *cachingReaderType) remove(elem *list.Element) {
+	cached := c.lru.Remove(elem).(*cachedReadType)
+	delete(c.byKey, cached.Key)
+	c.byteCnt -= cached.Size
+}
+
+// entriesSize estimates how many bytes entries take up in memory.
+func entriesSize(entries []*Entry) int64 {
+	var result int64
+	for _, entry := range entries {
+		result += kEntryOverhead
+		for name := range entry.Values {
+			result += int64(len(name)) + kValueOverhead
+		}
+	}
+	return result
+}
+
+// midnightOf returns midnight UTC of the day t falls on.
+func midnightOf(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,148 @@
+package chreader_test
+
+import (
+	"context"
+	"github.com/Symantec/uhura/chreader"
+	"github.com/Symantec/uhura/chreader/chtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestCachingReader(t *testing.T) {
+
+	Convey("With fake reader", t, func() {
+		fakeReader := &fakeReaderType{}
+		now := kNow
+		clock := func() time.Time { return now }
+		Convey("With default options", func() {
+			cachingReader := chreader.NewCustomCachingReader(
+				fakeReader, chreader.CachingOptions{}, clock)
+			Convey("Cache impervious to mutations", func() {
+				entries, _ := cachingReader.Read(
+					"instance", kNow.Add(-3*time.Hour), kNow)
+				So(entries, ShouldHaveLength, 3)
+				entries[0] = nil
+				entriesAgain, _ := cachingReader.Read(
+					"instance", kNow.Add(-3*time.Hour), kNow)
+				So(entriesAgain, ShouldHaveLength, 3)
+				So(entriesAgain[0], ShouldNotBeNil)
+				So(fakeReader.UseCount, ShouldEqual, 1)
+			})
+			Convey("Reads including today expire", func() {
+				cachingReader.Read("instance", kNow.Add(-3*time.Hour), kNow)
+				now = kNow.Add(59 * time.Second)
+				cachingReader.Read("instance", kNow.Add(-3*time.Hour), kNow)
+				So(fakeReader.UseCount, ShouldEqual, 1)
+				now = kNow.Add(time.Minute)
+				cachingReader.Read("instance", kNow.Add(-3*time.Hour), kNow)
+				So(fakeReader.UseCount, ShouldEqual, 2)
+			})
+			Convey("Reads of past days do not expire", func() {
+				cachingReader.Read(
+					"instance", kMidnight.Add(-3*time.Hour), kMidnight)
+				now = kNow.Add(10 * 24 * time.Hour)
+				cachingReader.Read(
+					"instance", kMidnight.Add(-3*time.Hour), kMidnight)
+				So(fakeReader.UseCount, ShouldEqual, 1)
+			})
+			Convey("Errors should propogate but not be cached", func() {
+				_, err := cachingReader.Read(
+					"error", kNow.Add(-time.Hour), kNow)
+				So(err, ShouldNotBeNil)
+				_, err = cachingReader.Read(
+					"error", kNow.Add(-time.Hour), kNow)
+				So(err, ShouldNotBeNil)
+				So(fakeReader.UseCount, ShouldEqual, 2)
+			})
+		})
+		Convey("With past TTL", func() {
+			cachingReader := chreader.NewCustomCachingReader(
+				fakeReader,
+				chreader.CachingOptions{PastTTL: time.Hour},
+				clock)
+			cachingReader.Read(
+				"instance", kMidnight.Add(-3*time.Hour), kMidnight)
+			now = kNow.Add(time.Hour)
+			cachingReader.Read(
+				"instance", kMidnight.Add(-3*time.Hour), kMidnight)
+			So(fakeReader.UseCount, ShouldEqual, 2)
+		})
+		Convey("With entry limit, least recently used evicted", func() {
+			cachingReader := chreader.NewCustomCachingReader(
+				fakeReader,
+				chreader.CachingOptions{MaxEntries: 2},
+				clock)
+			cachingReader.Read("a", kNow.Add(-3*time.Hour), kNow)
+			cachingReader.Read("b", kNow.Add(-3*time.Hour), kNow)
+			cachingReader.Read("a", kNow.Add(-3*time.Hour), kNow)
+			cachingReader.Read("c", kNow.Add(-3*time.Hour), kNow)
+			So(fakeReader.UseCount, ShouldEqual, 3)
+			// "a" still cached, "b" evicted
+			cachingReader.Read("a", kNow.Add(-3*time.Hour), kNow)
+			So(fakeReader.UseCount, ShouldEqual, 3)
+			cachingReader.Read("b", kNow.Add(-3*time.Hour), kNow)
+			So(fakeReader.UseCount, ShouldEqual, 4)
+		})
+		Convey("With byte limit, large reads not cached", func() {
+			cachingReader := chreader.NewCustomCachingReader(
+				fakeReader,
+				chreader.CachingOptions{MaxBytes: 1000},
+				clock)
+			cachingReader.Read("a", kNow.Add(-3*time.Hour), kNow)
+			cachingReader.Read("a", kNow.Add(-3*time.Hour), kNow)
+			So(fakeReader.UseCount, ShouldEqual, 1)
+			cachingReader.Read("a", kNow.Add(-300*time.Hour), kNow)
+			cachingReader.Read("a", kNow.Add(-300*time.Hour), kNow)
+			So(fakeReader.UseCount, ShouldEqual, 3)
+		})
+	})
+	Convey("With fake CloudHealth server", t, func() {
+		server := chtest.NewServer(chtest.Options{
+			Metrics: []string{"mem:used", "cpu:used"},
+			Now:     kNow,
+		})
+		defer server.Close()
+		now := kNow
+		cachingReader := chreader.NewCustomCachingReader(
+			chreader.NewCustomReader(
+				chreader.Config{BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				}),
+			chreader.CachingOptions{MetaDataTTL: time.Minute},
+			func() time.Time {
+				return now
+			})
+		Convey("Metrics sorted and cached", func() {
+			metrics, err := chreader.ReadMetrics(
+				context.Background(), cachingReader, "a")
+			So(err, ShouldBeNil)
+			So(metrics, ShouldResemble, []string{"cpu:used", "mem:used"})
+			metaData, err := chreader.ReadMetaData(
+				context.Background(), cachingReader, "a")
+			So(err, ShouldBeNil)
+			metaData.Keys[0] = "changed"
+			metrics, err = chreader.ReadMetrics(
+				context.Background(), cachingReader, "a")
+			So(err, ShouldBeNil)
+			So(metrics, ShouldResemble, []string{"cpu:used", "mem:used"})
+			So(server.Requests(), ShouldHaveLength, 1)
+		})
+		Convey("Metadata expires", func() {
+			chreader.ReadMetrics(context.Background(), cachingReader, "a")
+			now = kNow.Add(time.Minute)
+			chreader.ReadMetrics(context.Background(), cachingReader, "a")
+			So(server.Requests(), ShouldHaveLength, 2)
+		})
+		Convey("Metadata cached by granularity", func() {
+			chreader.ReadMetrics(context.Background(), cachingReader, "a")
+			chreader.ReadMetrics(
+				chreader.WithGranularity(context.Background(), "day"),
+				cachingReader,
+				"a")
+			So(server.Requests(), ShouldHaveLength, 2)
+		})
+	})
+}
@@ -2,14 +2,27 @@ package chreader
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	neturl "net/url"
+	"strings"
 	"time"
 )
 
+const (
+	kDefaultConnectTimeout = 30 * time.Second
+	kDefaultReadTimeout    = 2 * time.Minute
+	kDefaultMaxIdleConns   = 10
+)
+
 var (
 	kErrMissingMetaData     = errors.New("Metadata chunk missing")
 	kErrMissingTimestamp    = errors.New("Missing timestamp")
@@ -22,119 +35,489 @@ type metaDataType struct {
 	Keys        []string `json:"keys"`
 }
 
-type datasetType struct {
-	Metadata *metaDataType   `json:"metadata"`
-	Values   [][]interface{} `json:"values"`
-}
-
 type requestType struct {
 	Next *string `json:"next"`
 }
 
-type responseType struct {
-	Datasets []datasetType `json:"datasets"`
-	Request  requestType   `json:"request"`
+type chType struct {
+	client *http.Client
 }
 
-type chType struct {
+func newCH(c *Config) (*chType, error) {
+	client, err := newHTTPClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return &chType{client: client}, nil
+}
+
+func mustNewCH(c *Config) *chType {
+	result, err := newCH(c)
+	if err != nil {
+		panic(err)
+	}
+	return result
 }
 
 func (c *chType) Fetch(url string) (*CHResult, error) {
-	return fetch(url)
+	return fetch(context.Background(), c.client, url)
 }
 
-func fetch(url string) (*CHResult, error) {
-	var client http.Client
-	resp, err := client.Get(url)
+func (c *chType) FetchContext(ctx context.Context, url string) (
+	*CHResult, error) {
+	return fetch(ctx, c.client, url)
+}
+
+func newHTTPClient(c *Config) (*http.Client, error) {
+	connectTimeout := c.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = kDefaultConnectTimeout
+	}
+	readTimeout := c.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = kDefaultReadTimeout
+	}
+	maxIdleConns := c.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = kDefaultMaxIdleConns
+	}
+	proxy := http.ProxyFromEnvironment
+	if c.ProxyUrl != "" {
+		proxyUrl, err := neturl.Parse(c.ProxyUrl)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+	tlsConfig, err := newTLSConfig(c)
 	if err != nil {
 		return nil, err
 	}
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			DialContext:         dialer.DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: connectTimeout,
+			// All our requests go to the same host
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		Timeout: readTimeout,
+	}, nil
+}
+
+// newTLSConfig returns the TLS configuration for c or nil if c uses the
+// defaults.
+func newTLSConfig(c *Config) (*tls.Config, error) {
+	if c.CaFile == "" && c.CertFile == "" && c.KeyFile == "" {
+		return nil, nil
+	}
+	var result tls.Config
+	if c.CaFile != "" {
+		pemCerts, err := ioutil.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return nil, fmt.Errorf(
+				"chreader: No certificates found in %s", c.CaFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New(
+				"chreader: certFile and keyFile must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return &result, nil
+}
+
+func fetch(ctx context.Context, client *http.Client, url string) (
+	*CHResult, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, redactUrlError(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		// Report cancellation plainly instead of wrapped in a url.Error
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, redactUrlError(err)
+	}
 	defer resp.Body.Close()
 	date := resp.Header.Get("Date")
 	// If status code is 400 or greater, assume output is the error
 	if resp.StatusCode >= 400 {
 		var buffer bytes.Buffer
 		buffer.ReadFrom(resp.Body)
-		return nil, errors.New(buffer.String())
-	}
-	// Otherwise unmarshal response and extract the metric values
-	res, err := extractResponse(resp.Body)
-	if err != nil {
-		return nil, err
+		return nil, &APIError{
+			Status:     resp.StatusCode,
+			Message:    extractErrorMessage(buffer.Bytes()),
+			URL:        redactUrl(url),
+			Date:       date,
+			RetryAfter: resp.Header.Get("Retry-After"),
+		}
 	}
+	// Otherwise decode response and extract the metric values
 	result := CHResult{Date: date}
-	result.Entries, result.Next, err = extractMetrics(res)
+	result.Datasets, result.Next, err = decodeResponse(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	result.Entries = allEntries(result.Datasets)
 	return &result, nil
 }
 
-func extractResponse(reader io.Reader) (*responseType, error) {
-	decoder := json.NewDecoder(reader)
-	var result *responseType
-	if err := decoder.Decode(&result); err != nil {
-		return nil, err
+func hasStatus(err error, statuses ...int) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, status := range statuses {
+		if apiErr.Status == status {
+			return true
+		}
 	}
-	return result, nil
+	return false
 }
 
-func extractMetrics(res *responseType) ([]*Entry, string, error) {
-	var result []*Entry
-	if len(res.Datasets) > 1 {
-		return nil, "", errors.New("Multiple datasets not supported")
+// extractErrorMessage extracts the message from a CloudHealth error
+// response like '{"error": "Invalid API key"}'. If body isn't in that
+// form, extractErrorMessage returns body as is.
+func extractErrorMessage(body []byte) string {
+	var errorResponse struct {
+		Error string `json:"error"`
 	}
-	for _, dataset := range res.Datasets {
-		if dataset.Metadata == nil {
-			return nil, "", kErrMissingMetaData
-		}
-		if err := extractInstanceMetrics(
-			dataset.Metadata.Keys, dataset.Values, &result); err != nil {
-			return nil, "", err
-		}
+	if err := json.Unmarshal(body, &errorResponse); err == nil &&
+		errorResponse.Error != "" {
+		return errorResponse.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// redactUrl returns rawUrl with the value of the api_key parameter hidden.
+// redactUrlError keeps the API key out of the message of err if err is
+// a url.Error.
+func redactUrlError(err error) error {
+	if uerr, ok := err.(*neturl.Error); ok {
+		uerr.URL = redactUrl(uerr.URL)
+	}
+	return err
+}
+
+func redactUrl(rawUrl string) string {
+	parsedUrl, err := neturl.Parse(rawUrl)
+	if err != nil {
+		return "<unparseable URL>"
 	}
+	values := parsedUrl.Query()
+	if _, ok := values["api_key"]; !ok {
+		return rawUrl
+	}
+	values.Set("api_key", "REDACTED")
+	parsedUrl.RawQuery = values.Encode()
+	return parsedUrl.String()
+}
+
+// decodeResponse decodes a CloudHealth response from reader and returns
+// its datasets and next URL. decodeResponse decodes the values one row at
+// a time into entries so that it never has more than one row of raw JSON
+// values in memory. The entries of the whole page are still in memory
+// when decodeResponse returns.
+func decodeResponse(reader io.Reader) ([]*Dataset, string, error) {
+	decoder := json.NewDecoder(reader)
+	builder := newDatasetsBuilder()
 	nextUrl := ""
-	if res.Request.Next != nil {
-		nextUrl = *res.Request.Next
-	}
-	return result, nextUrl, nil
-}
-
-func extractInstanceMetrics(
-	keys []string, values [][]interface{}, sink *[]*Entry) error {
-	for _, group := range values {
-		if len(group) != len(keys) {
-			return kErrWrongNumberOfValues
-		}
-		entry := Entry{Values: make(map[string]float64)}
-		timeSet := false
-		for i, value := range group {
-			if keys[i] == "assetId" {
-				// do nothing
-			} else if keys[i] == "timestamp" {
-				timestampStr, ok := value.(string)
-				if !ok {
-					return fmt.Errorf("%v should be a string.", value)
+	err := decodeObject(decoder, func(key string) error {
+		switch key {
+		case "datasets":
+			return decodeArray(decoder, func() error {
+				return decodeDataset(decoder, builder)
+			})
+		case "request":
+			var request requestType
+			if err := decoder.Decode(&request); err != nil {
+				return err
+			}
+			if request.Next != nil {
+				nextUrl = *request.Next
+			}
+			return nil
+		default:
+			return skipValue(decoder)
+		}
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return builder.Datasets(), nextUrl, nil
+}
+
+// decodeDataset decodes one dataset of a response from decoder and adds
+// it to builder.
+func decodeDataset(decoder *json.Decoder, builder *datasetsBuilderType) error {
+	var metaData *metaDataType
+	// Rows that come before the metadata
+	var pending [][]interface{}
+	rowCount := 0
+	err := decodeObject(decoder, func(key string) error {
+		switch key {
+		case "metadata":
+			if err := decoder.Decode(&metaData); err != nil {
+				return err
+			}
+			if metaData == nil {
+				return nil
+			}
+			builder.Begin(metaData)
+			for _, row := range pending {
+				if err := builder.Add(row); err != nil {
+					return err
 				}
-				timestamp, err := time.Parse(
-					"2006-01-02T15:04:05Z07:00", timestampStr)
-				if err != nil {
+			}
+			pending = nil
+			return nil
+		case "values":
+			return decodeArray(decoder, func() error {
+				var row []interface{}
+				if err := decoder.Decode(&row); err != nil {
 					return err
 				}
-				entry.Time = timestamp
-				timeSet = true
-			} else if value != nil {
-				val, ok := value.(float64)
-				if !ok {
-					return fmt.Errorf("%v should be a float.", value)
+				rowCount++
+				if metaData == nil {
+					pending = append(pending, row)
+					return nil
 				}
-				entry.Values[keys[i]] = val
-			}
+				return builder.Add(row)
+			})
+		default:
+			return skipValue(decoder)
 		}
-		if !timeSet {
-			return kErrMissingTimestamp
+	})
+	if err != nil {
+		return err
+	}
+	if metaData == nil {
+		return kErrMissingMetaData
+	}
+	builder.End(rowCount)
+	return nil
+}
+
+// decodeObject reads a JSON object from decoder calling decodeValue with
+// each key. decodeValue must read the value of that key from decoder.
+// decodeObject treats null like an empty object.
+func decodeObject(
+	decoder *json.Decoder, decodeValue func(key string) error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('{') {
+		return fmt.Errorf("Expected JSON object, got %v", token)
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if err := decodeValue(token.(string)); err != nil {
+			return err
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+// decodeArray reads a JSON array from decoder calling decodeElement for
+// each element. decodeElement must read the element from decoder.
+// decodeArray treats null like an empty array.
+func decodeArray(decoder *json.Decoder, decodeElement func() error) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("Expected JSON array, got %v", token)
+	}
+	for decoder.More() {
+		if err := decodeElement(); err != nil {
+			return err
 		}
-		*sink = append(*sink, &entry)
 	}
+	_, err = decoder.Token()
+	return err
+}
+
+func skipValue(decoder *json.Decoder) error {
+	var ignored json.RawMessage
+	return decoder.Decode(&ignored)
+}
+
+// datasetsBuilderType builds the datasets of a response one row of values
+// at a time. A dataset in the response may have values for several assets;
+// several datasets may have values for the same asset.
+type datasetsBuilderType struct {
+	result    []*Dataset
+	byAssetId map[string]*Dataset
+	// Assets with entries from more than one dataset
+	merged map[*Dataset]bool
+
+	// The metadata of the current dataset in the response
+	metaData MetaData
+	// The assets in the current dataset in the response
+	seen map[*Dataset]bool
+}
+
+func newDatasetsBuilder() *datasetsBuilderType {
+	return &datasetsBuilderType{
+		byAssetId: make(map[string]*Dataset),
+		merged:    make(map[*Dataset]bool),
+	}
+}
+
+// Begin starts a new dataset in the response.
+func (b *datasetsBuilderType) Begin(metaData *metaDataType) {
+	b.metaData = MetaData{
+		AssetType:   metaData.AssetType,
+		Granularity: metaData.Granularity,
+		Keys:        metaData.Keys,
+	}
+	b.seen = make(map[*Dataset]bool)
+}
+
+// Add adds one row of values of the current dataset in the response.
+func (b *datasetsBuilderType) Add(row []interface{}) error {
+	assetId, entry, err := extractInstanceMetric(b.metaData.Keys, row)
+	if err != nil {
+		return err
+	}
+	ds, ok := b.byAssetId[assetId]
+	if !ok {
+		ds = &Dataset{AssetId: assetId, MetaData: b.metaData}
+		b.byAssetId[assetId] = ds
+		b.result = append(b.result, ds)
+	} else if !b.seen[ds] {
+		ds.MetaData.Keys = unionKeys(ds.MetaData.Keys, b.metaData.Keys)
+		b.merged[ds] = true
+	}
+	b.seen[ds] = true
+	ds.Entries = append(ds.Entries, entry)
 	return nil
 }
+
+// End ends the current dataset in the response. rowCount is the number of
+// rows of values it had.
+func (b *datasetsBuilderType) End(rowCount int) {
+	// Keep datasets without values for their metadata
+	if rowCount == 0 {
+		if _, ok := b.byAssetId[""]; !ok {
+			ds := &Dataset{MetaData: b.metaData}
+			b.byAssetId[""] = ds
+			b.result = append(b.result, ds)
+		}
+	}
+}
+
+// Datasets returns the built datasets.
+func (b *datasetsBuilderType) Datasets() []*Dataset {
+	for ds := range b.merged {
+		ds.Entries = combineEntries(ds.Entries)
+	}
+	return b.result
+}
+
+// allEntries returns the entries of all the datasets.
+func allEntries(datasets []*Dataset) []*Entry {
+	if len(datasets) == 1 {
+		return datasets[0].Entries
+	}
+	var result []*Entry
+	for _, dataset := range datasets {
+		result = append(result, dataset.Entries...)
+	}
+	return result
+}
+
+// unionKeys returns keys with any newKeys not already in keys appended.
+func unionKeys(keys, newKeys []string) []string {
+	var result []string
+	for _, key := range newKeys {
+		found := false
+		for _, existing := range keys {
+			if existing == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, key)
+		}
+	}
+	if len(result) == 0 {
+		return keys
+	}
+	return append(append([]string(nil), keys...), result...)
+}
+
+// extractInstanceMetric returns the entry in one row of values along
+// with the asset Id of that entry. The asset Id is empty if there is no
+// "assetId" column.
+func extractInstanceMetric(keys []string, row []interface{}) (
+	string, *Entry, error) {
+	if len(row) != len(keys) {
+		return "", nil, kErrWrongNumberOfValues
+	}
+	entry := Entry{Values: make(map[string]float64)}
+	timeSet := false
+	assetId := ""
+	for i, value := range row {
+		if keys[i] == "assetId" {
+			if assetIdStr, ok := value.(string); ok {
+				assetId = assetIdStr
+			}
+		} else if keys[i] == "timestamp" {
+			timestampStr, ok := value.(string)
+			if !ok {
+				return "", nil, fmt.Errorf("%v should be a string.", value)
+			}
+			timestamp, err := time.Parse(
+				"2006-01-02T15:04:05Z07:00", timestampStr)
+			if err != nil {
+				return "", nil, err
+			}
+			entry.Time = timestamp
+			timeSet = true
+		} else if value != nil {
+			val, ok := value.(float64)
+			if !ok {
+				return "", nil, fmt.Errorf("%v should be a float.", value)
+			}
+			entry.Values[keys[i]] = val
+		}
+	}
+	if !timeSet {
+		return "", nil, kErrMissingTimestamp
+	}
+	return assetId, &entry, nil
+}
@@ -0,0 +1,421 @@
+package chreader_test
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAPIError(t *testing.T) {
+	Convey("With failing server", t, func() {
+		flakyServer := &flakyServerType{}
+		server := httptest.NewServer(flakyServer)
+		defer server.Close()
+		url := server.URL + "/metrics/v1?api_key=secret&asset=assetId"
+		Convey("Unauthorized", func() {
+			flakyServer.Statuses = []int{401}
+			_, err := chreader.DefaultCH.Fetch(url)
+			So(chreader.IsUnauthorized(err), ShouldBeTrue)
+			So(chreader.IsNotFound(err), ShouldBeFalse)
+			So(chreader.IsRateLimited(err), ShouldBeFalse)
+			var apiErr *chreader.APIError
+			So(errors.As(err, &apiErr), ShouldBeTrue)
+			So(apiErr.Status, ShouldEqual, http.StatusUnauthorized)
+			So(apiErr.Message, ShouldEqual, "Something went wrong")
+			So(apiErr.Date, ShouldEqual, kNow.Format(http.TimeFormat))
+			So(apiErr.URL, ShouldNotContainSubstring, "secret")
+			So(apiErr.URL, ShouldContainSubstring, "asset=assetId")
+			So(err.Error(), ShouldNotContainSubstring, "secret")
+		})
+		Convey("Not found", func() {
+			flakyServer.Statuses = []int{404}
+			_, err := chreader.DefaultCH.Fetch(url)
+			So(chreader.IsNotFound(err), ShouldBeTrue)
+			So(chreader.IsUnauthorized(err), ShouldBeFalse)
+		})
+		Convey("Rate limited", func() {
+			flakyServer.Statuses = []int{429}
+			_, err := chreader.DefaultCH.Fetch(url)
+			So(chreader.IsRateLimited(err), ShouldBeTrue)
+		})
+		Convey("Other errors", func() {
+			So(chreader.IsRateLimited(errors.New("foo")), ShouldBeFalse)
+			So(chreader.IsUnauthorized(nil), ShouldBeFalse)
+		})
+	})
+	Convey("Connection errors hide API key", t, func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		url := server.URL + "/metrics/v1?api_key=secret&asset=assetId"
+		server.Close()
+		_, err := chreader.DefaultCH.Fetch(url)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldNotContainSubstring, "secret")
+	})
+	Convey("Bad URLs hide API key", t, func() {
+		_, err := chreader.DefaultCH.Fetch(
+			"http://chapi.example.com/metrics/v1?api_key=secret&asset=\x7f")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldNotContainSubstring, "secret")
+	})
+}
+
+// pageServerType serves one page of results and records requested URLs.
+type pageServerType struct {
+	Urls []*url.URL
+}
+
+func (s *pageServerType) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Urls = append(s.Urls, r.URL)
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	fmt.Fprintln(w, kOnePage)
+}
+
+func TestTransportSettings(t *testing.T) {
+	Convey("With temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "transport")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		pageServer := &pageServerType{}
+		Convey("Custom base URL and CA bundle", func() {
+			server := httptest.NewTLSServer(pageServer)
+			defer server.Close()
+			caFile := filepath.Join(dir, "ca.pem")
+			So(
+				ioutil.WriteFile(
+					caFile,
+					pem.EncodeToMemory(&pem.Block{
+						Type:  "CERTIFICATE",
+						Bytes: server.Certificate().Raw,
+					}),
+					0644),
+				ShouldBeNil)
+			reader, err := chreader.NewCheckedReader(chreader.Config{
+				ApiKey:  kApiKey,
+				BaseUrl: server.URL + "/staging/metrics/v1",
+				CaFile:  caFile,
+			})
+			So(err, ShouldBeNil)
+			_, err = reader.Read(
+				kAssetId, time.Now().Add(-time.Minute), time.Now())
+			So(err, ShouldBeNil)
+			So(pageServer.Urls, ShouldNotBeEmpty)
+			So(pageServer.Urls[0].Path, ShouldEqual, "/staging/metrics/v1")
+			So(pageServer.Urls[0].Query().Get("api_key"), ShouldEqual, kApiKey)
+		})
+		Convey("Untrusted server fails", func() {
+			server := httptest.NewTLSServer(pageServer)
+			defer server.Close()
+			reader, err := chreader.NewCheckedReader(chreader.Config{
+				ApiKey:  kApiKey,
+				BaseUrl: server.URL + "/metrics/v1",
+				Retry:   chreader.RetryPolicy{MaxAttempts: 1},
+			})
+			So(err, ShouldBeNil)
+			_, err = reader.Read(
+				kAssetId, time.Now().Add(-time.Minute), time.Now())
+			So(err, ShouldNotBeNil)
+			So(pageServer.Urls, ShouldBeEmpty)
+		})
+		Convey("Proxy URL", func() {
+			proxy := httptest.NewServer(pageServer)
+			defer proxy.Close()
+			reader, err := chreader.NewCheckedReader(chreader.Config{
+				ApiKey:   kApiKey,
+				BaseUrl:  "http://chapi.example.com/metrics/v1",
+				ProxyUrl: proxy.URL,
+			})
+			So(err, ShouldBeNil)
+			_, err = reader.Read(
+				kAssetId, time.Now().Add(-time.Minute), time.Now())
+			So(err, ShouldBeNil)
+			So(pageServer.Urls, ShouldNotBeEmpty)
+			So(pageServer.Urls[0].Host, ShouldEqual, "chapi.example.com")
+		})
+		Convey("Bad settings", func() {
+			_, err := chreader.NewCheckedReader(chreader.Config{
+				CaFile: filepath.Join(dir, "missing.pem"),
+			})
+			So(err, ShouldNotBeNil)
+			emptyFile := filepath.Join(dir, "empty.pem")
+			So(ioutil.WriteFile(emptyFile, nil, 0644), ShouldBeNil)
+			_, err = chreader.NewCheckedReader(chreader.Config{CaFile: emptyFile})
+			So(err, ShouldNotBeNil)
+			_, err = chreader.NewCheckedReader(chreader.Config{CertFile: emptyFile})
+			So(err, ShouldNotBeNil)
+			_, err = chreader.NewCheckedReader(chreader.Config{BaseUrl: ":bad"})
+			So(err, ShouldNotBeNil)
+			So(func() {
+				chreader.NewReader(chreader.Config{BaseUrl: ":bad"})
+			}, ShouldPanic)
+		})
+	})
+}
+
+const (
+	kMultipleDatasets = `{
+	"datasets": [{
+		"metadata": {
+			"assetType": "aws:ec2:instance",
+			"granularity": "hour",
+			"keys": ["assetId", "timestamp", "cpu:used"]
+		},
+		"values": [
+			["a", "2017-06-20T01:00:00+00:00", 1.0],
+			["b", "2017-06-20T01:00:00+00:00", 2.0],
+			["a", "2017-06-20T02:00:00+00:00", 3.0],
+			["b", "2017-06-20T02:00:00+00:00", 4.0]
+		]
+	}, {
+		"metadata": {
+			"assetType": "aws:ec2:instance",
+			"granularity": "hour",
+			"keys": ["assetId", "timestamp", "mem:used"]
+		},
+		"values": [
+			["a", "2017-06-20T01:00:00+00:00", 5.0],
+			["a", "2017-06-20T02:00:00+00:00", 6.0]
+		]
+	}],
+	"request": {"next": null}
+}`
+
+	kSimilarAssetIds = `{
+	"datasets": [{
+		"metadata": {
+			"assetType": "aws:ec2:instance",
+			"granularity": "hour",
+			"keys": ["assetId", "timestamp", "cpu:used"]
+		},
+		"values": [
+			["i-1234", "2017-06-20T01:00:00+00:00", 1.0]
+		]
+	}, {
+		"metadata": {
+			"assetType": "aws:ec2:instance:fs",
+			"granularity": "hour",
+			"keys": ["assetId", "timestamp", "fs:used"]
+		},
+		"values": [
+			["i-123:fs//xvda", "2017-06-20T01:00:00+00:00", 2.0]
+		]
+	}],
+	"request": {"next": null}
+}`
+)
+
+func TestDecodeResponse(t *testing.T) {
+	Convey("With server returning unusual JSON", t, func() {
+		var body string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(w, body)
+			}))
+		defer server.Close()
+		Convey("Values may come before metadata", func() {
+			body = `{
+				"unknown": [1, {"a": 2}],
+				"datasets": [{
+					"values": [
+						["2017-06-20T01:00:00+00:00", 1.0, null],
+						["2017-06-20T02:00:00+00:00", 2.0, 3.0]
+					],
+					"metadata": {
+						"granularity": "hour",
+						"keys": ["timestamp", "cpu:used", "mem:used"],
+						"unknown": "ignored"
+					}
+				}],
+				"request": {"next": "http://next"}
+			}`
+			result, err := chreader.DefaultCH.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(result.Next, ShouldEqual, "http://next")
+			So(result.Entries, ShouldHaveLength, 2)
+			So(result.Entries[0].Values, ShouldResemble, map[string]float64{
+				"cpu:used": 1.0,
+			})
+			So(result.Entries[1].Values, ShouldResemble, map[string]float64{
+				"cpu:used": 2.0,
+				"mem:used": 3.0,
+			})
+		})
+		Convey("Null datasets and next", func() {
+			body = `{"datasets": null, "request": {"next": null}}`
+			result, err := chreader.DefaultCH.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(result.Entries, ShouldBeEmpty)
+			So(result.Next, ShouldBeEmpty)
+		})
+		Convey("Missing metadata", func() {
+			body = `{"datasets": [{"values": []}]}`
+			_, err := chreader.DefaultCH.Fetch(server.URL)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Wrong number of values", func() {
+			body = `{"datasets": [{
+				"metadata": {"keys": ["timestamp", "cpu:used"]},
+				"values": [["2017-06-20T01:00:00+00:00"]]
+			}]}`
+			_, err := chreader.DefaultCH.Fetch(server.URL)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Truncated response", func() {
+			body = `{"datasets": [{
+				"metadata": {"keys": ["timestamp", "cpu:used"]},
+				"values": [["2017-06-20T01:00:00+00:00", 1.0]`
+			_, err := chreader.DefaultCH.Fetch(server.URL)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMultipleDatasets(t *testing.T) {
+	Convey("With server returning multiple datasets", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", kNow.Format(http.TimeFormat))
+				fmt.Fprintln(w, kMultipleDatasets)
+			}))
+		defer server.Close()
+		Convey("Datasets split and merged by asset", func() {
+			result, err := chreader.DefaultCH.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(result.Entries, ShouldHaveLength, 4)
+			So(result.Datasets, ShouldHaveLength, 2)
+			So(result.Datasets[0].AssetId, ShouldEqual, "a")
+			So(result.Datasets[0].Entries, ShouldHaveLength, 2)
+			So(result.Datasets[0].MetaData, ShouldResemble, chreader.MetaData{
+				AssetType:   "aws:ec2:instance",
+				Granularity: "hour",
+				Keys:        []string{"assetId", "timestamp", "cpu:used", "mem:used"},
+			})
+			So(result.Datasets[1].AssetId, ShouldEqual, "b")
+			So(result.Datasets[1].Entries, ShouldHaveLength, 2)
+		})
+		Convey("Reader returns entries of requested asset", func() {
+			reader := chreader.NewCustomReader(
+				chreader.Config{BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				})
+			entries, err := reader.Read(
+				"a", kMidnight.Add(time.Hour), kMidnight.Add(2*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Time, ShouldEqual, kMidnight.Add(time.Hour))
+			So(entries[0].Values, ShouldResemble, map[string]float64{
+				"cpu:used": 1.0,
+				"mem:used": 5.0,
+			})
+			entries, err = reader.Read(
+				"b", kMidnight.Add(time.Hour), kMidnight.Add(2*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Time, ShouldEqual, kMidnight.Add(time.Hour))
+			So(entries[0].Values, ShouldResemble, map[string]float64{
+				"cpu:used": 2.0,
+			})
+		})
+		Convey("Reader returns nothing for assets without datasets", func() {
+			reader := chreader.NewCustomReader(
+				chreader.Config{BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				})
+			entries, err := reader.Read(
+				"c", kMidnight.Add(time.Hour), kMidnight.Add(2*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, ShouldBeEmpty)
+		})
+		Convey("Reader returns metadata of requested asset", func() {
+			reader := chreader.NewCustomReader(
+				chreader.Config{BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				})
+			metaData, err := chreader.ReadMetaData(
+				context.Background(), reader, "a")
+			So(err, ShouldBeNil)
+			So(metaData.Granularity, ShouldEqual, "hour")
+			So(metaData.Interval(), ShouldEqual, time.Hour)
+			So(metaData.Metrics(), ShouldResemble, []string{"cpu:used", "mem:used"})
+			cachingReader := chreader.NewCachingReader(
+				reader, chreader.CachingOptions{})
+			metaData, err = chreader.ReadMetaData(
+				context.Background(), cachingReader, "b")
+			So(err, ShouldBeNil)
+			So(metaData.Metrics(), ShouldContain, "cpu:used")
+		})
+		Convey("Assets without datasets have no metadata", func() {
+			reader := chreader.NewCustomReader(
+				chreader.Config{BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				})
+			_, err := chreader.ReadMetaData(context.Background(), reader, "c")
+			So(err, ShouldEqual, chreader.ErrNoMetaData)
+			metrics, err := chreader.ReadMetrics(
+				context.Background(), reader, "c")
+			So(err, ShouldBeNil)
+			So(metrics, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestSimilarAssetIds(t *testing.T) {
+	Convey("With server returning datasets with similar asset ids", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", kNow.Format(http.TimeFormat))
+				fmt.Fprintln(w, kSimilarAssetIds)
+			}))
+		defer server.Close()
+		reader := chreader.NewCustomReader(
+			chreader.Config{BaseUrl: server.URL},
+			chreader.DefaultCH,
+			func() time.Time {
+				return kNow
+			})
+		read := func(assetId string) []*chreader.Entry {
+			entries, err := reader.Read(
+				assetId, kMidnight.Add(time.Hour), kMidnight.Add(2*time.Hour))
+			So(err, ShouldBeNil)
+			return entries
+		}
+		Convey("Assets under the requested one match", func() {
+			entries := read("i-123")
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Values, ShouldResemble, map[string]float64{
+				"fs:used": 2.0,
+			})
+			entries = read("i-123:fs//")
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Values, ShouldResemble, map[string]float64{
+				"fs:used": 2.0,
+			})
+		})
+		Convey("Asset ids merely starting with the requested one don't", func() {
+			So(read("i-12"), ShouldBeEmpty)
+			entries := read("i-1234")
+			So(entries, ShouldHaveLength, 1)
+			So(entries[0].Values, ShouldResemble, map[string]float64{
+				"cpu:used": 1.0,
+			})
+		})
+	})
+}
@@ -0,0 +1,376 @@
+// Package chtest provides a fake CloudHealth metrics API server for tests.
+package chtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultPageSize    = 1000
+	kDefaultGranularity = "hour"
+	kExplicitTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+var (
+	kGranularityIntervals = map[string]time.Duration{
+		"minute": time.Minute,
+		"hour":   time.Hour,
+		"day":    24 * time.Hour,
+		"week":   7 * 24 * time.Hour,
+	}
+)
+
+// Options configures a Server.
+type Options struct {
+	// If set, requests with any other API key fail with 401.
+	ApiKey string
+
+	// If set, the only assets the server knows. Requests for other
+	// assets fail with 404. Empty means the server knows every asset.
+	Assets []string
+
+	// The metric names of each asset. Empty means just "cpu:used".
+	Metrics []string
+
+	// Returns the value of metric for assetId at t. nil means the hour of
+	// the UTC day of t.
+	Value func(assetId, metric string, t time.Time) float64
+
+	// The maximum number of rows per page. Zero means 1000.
+	PageSize int
+
+	// The granularity to serve when requests don't ask for one.
+	// Empty means "hour".
+	Granularity string
+
+	// The starting time of the server clock. Zero means the current time.
+	Now time.Time
+
+	// How far to move the server clock after each request. Use to have
+	// the UTC day change in the middle of a read.
+	Step time.Duration
+
+	// How long to wait before responding to each request.
+	Latency time.Duration
+}
+
+// Server is a fake CloudHealth metrics API. It serves values for each
+// asset at every interval of the requested granularity over the named
+// time range or explicit from and to times of each request. Several
+// comma separated assets may be requested at once. The server decides
+// what today is from its own clock, which it sends in the Date header,
+// so tests can give it a clock skewed from the one of the client.
+type Server struct {
+	// The URL of the metrics API such as "http://127.0.0.1:1234/metrics/v1"
+	URL string
+
+	options Options
+	server  *httptest.Server
+
+	mu         sync.Mutex
+	now        time.Time
+	failures   []int
+	retryAfter string
+	requests   []*url.URL
+}
+
+// NewServer starts a new server. Callers must call Close when done.
+func NewServer(options Options) *Server {
+	if options.PageSize <= 0 {
+		options.PageSize = kDefaultPageSize
+	}
+	if options.Granularity == "" {
+		options.Granularity = kDefaultGranularity
+	}
+	if len(options.Metrics) == 0 {
+		options.Metrics = []string{"cpu:used"}
+	}
+	if options.Value == nil {
+		options.Value = hourOfDay
+	}
+	now := options.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	result := &Server{options: options, now: now}
+	result.server = httptest.NewServer(http.HandlerFunc(result.serve))
+	result.URL = result.server.URL + "/metrics/v1"
+	return result
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// SetTime sets the server clock to now.
+func (s *Server) SetTime(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Time returns the time on the server clock.
+func (s *Server) Time() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Fail makes the server respond to the next requests with statuses, one
+// request per status, before serving values again. If retryAfter is
+// non-empty, the error responses carry it in the Retry-After header.
+func (s *Server) Fail(retryAfter string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+	s.retryAfter = retryAfter
+}
+
+// Requests returns the URLs requested so far in order.
+func (s *Server) Requests() []*url.URL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]*url.URL, len(s.requests))
+	copy(result, s.requests)
+	return result
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.options.Latency > 0 {
+		select {
+		case <-time.After(s.options.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	now, status, retryAfter := s.nextRequest(r.URL)
+	w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+	if status != 0 {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		writeError(w, status, http.StatusText(status))
+		return
+	}
+	values := r.URL.Query()
+	if s.options.ApiKey != "" && values.Get("api_key") != s.options.ApiKey {
+		writeError(w, http.StatusUnauthorized, "Invalid API key")
+		return
+	}
+	assetIds := strings.Split(values.Get("asset"), ",")
+	for _, assetId := range assetIds {
+		if !s.knows(assetId) {
+			writeError(w, http.StatusNotFound, "Asset not found: "+assetId)
+			return
+		}
+	}
+	granularity := values.Get("granularity")
+	if granularity == "" {
+		granularity = s.options.Granularity
+	}
+	interval, ok := kGranularityIntervals[granularity]
+	if !ok {
+		writeError(
+			w, http.StatusBadRequest, "Unknown granularity: "+granularity)
+		return
+	}
+	start, end, err := timeRange(values, now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := pageNumber(values)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var times []time.Time
+	for t := alignUp(start, interval); t.Before(end); t = t.Add(interval) {
+		times = append(times, t)
+	}
+	// Rows of every asset go on the pages in order.
+	first := (page - 1) * s.options.PageSize
+	last := page * s.options.PageSize
+	rowCount := len(times) * len(assetIds)
+	if last > rowCount {
+		last = rowCount
+	}
+	response := responseType{
+		Datasets: make([]*datasetType, 0, len(assetIds)),
+	}
+	if rowCount == 0 {
+		// Just the metadata
+		for _, assetId := range assetIds {
+			response.Datasets = append(
+				response.Datasets, s.newDataset(assetId, granularity))
+		}
+	}
+	for i := first; i < last; i++ {
+		assetId := assetIds[i/len(times)]
+		if len(response.Datasets) == 0 ||
+			response.Datasets[len(response.Datasets)-1].AssetId != assetId {
+			response.Datasets = append(
+				response.Datasets,
+				s.newDataset(assetId, granularity))
+		}
+		dataset := response.Datasets[len(response.Datasets)-1]
+		dataset.Values = append(
+			dataset.Values, s.row(assetId, times[i%len(times)]))
+	}
+	if last < rowCount {
+		nextUrl := *r.URL
+		nextUrl.Scheme = "http"
+		nextUrl.Host = r.Host
+		values.Set("page", strconv.Itoa(page+1))
+		nextUrl.RawQuery = values.Encode()
+		next := nextUrl.String()
+		response.Request.Next = &next
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&response)
+}
+
+// nextRequest records the request for requestUrl and returns the server
+// time along with the status to fail with, if any.
+func (s *Server) nextRequest(requestUrl *url.URL) (
+	now time.Time, status int, retryAfter string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, requestUrl)
+	now = s.now
+	s.now = s.now.Add(s.options.Step)
+	if len(s.failures) > 0 {
+		status = s.failures[0]
+		s.failures = s.failures[1:]
+		retryAfter = s.retryAfter
+	}
+	return
+}
+
+func (s *Server) knows(assetId string) bool {
+	if len(s.options.Assets) == 0 {
+		return assetId != ""
+	}
+	for _, known := range s.options.Assets {
+		if known == assetId {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) newDataset(assetId, granularity string) *datasetType {
+	return &datasetType{
+		AssetId: assetId,
+		MetaData: metaDataType{
+			AssetType:   "aws:ec2:instance",
+			Granularity: granularity,
+			Keys: append(
+				[]string{"assetId", "timestamp"}, s.options.Metrics...),
+		},
+		Values: [][]interface{}{},
+	}
+}
+
+func (s *Server) row(assetId string, t time.Time) []interface{} {
+	result := []interface{}{assetId, t.UTC().Format(time.RFC3339)}
+	for _, metric := range s.options.Metrics {
+		result = append(result, s.options.Value(assetId, metric, t))
+	}
+	return result
+}
+
+type metaDataType struct {
+	AssetType   string   `json:"assetType"`
+	Granularity string   `json:"granularity"`
+	Keys        []string `json:"keys"`
+}
+
+type datasetType struct {
+	AssetId  string          `json:"-"`
+	MetaData metaDataType    `json:"metadata"`
+	Values   [][]interface{} `json:"values"`
+}
+
+type responseType struct {
+	Datasets []*datasetType `json:"datasets"`
+	Request  struct {
+		Next *string `json:"next"`
+	} `json:"request"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// timeRange returns the start and end of the time range that values
+// ask for when the server time is now.
+func timeRange(values url.Values, now time.Time) (
+	start, end time.Time, err error) {
+	if from := values.Get("from"); from != "" {
+		start, err = time.Parse(kExplicitTimeFormat, from)
+		if err != nil {
+			return
+		}
+		end, err = time.Parse(kExplicitTimeFormat, values.Get("to"))
+		if err != nil {
+			return
+		}
+		if end.After(now) {
+			end = now
+		}
+		return
+	}
+	midnight := now.UTC().Truncate(24 * time.Hour)
+	name := values.Get("time_range")
+	switch name {
+	case "today":
+		return midnight, now, nil
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), midnight, nil
+	}
+	daysStr := strings.TrimSuffix(strings.TrimPrefix(name, "last_"), "_days")
+	days, atoiErr := strconv.Atoi(daysStr)
+	if atoiErr != nil || days <= 0 || days > 31 || daysStr == name {
+		err = fmt.Errorf("Unknown time range: %s", name)
+		return
+	}
+	return midnight.AddDate(0, 0, -days), midnight, nil
+}
+
+func pageNumber(values url.Values) (int, error) {
+	pageStr := values.Get("page")
+	if pageStr == "" {
+		return 1, nil
+	}
+	page, err := strconv.Atoi(pageStr)
+	if err != nil || page < 1 {
+		return 0, fmt.Errorf("Bad page: %s", pageStr)
+	}
+	return page, nil
+}
+
+// alignUp returns the first multiple of interval since the zero time at
+// or after t.
+func alignUp(t time.Time, interval time.Duration) time.Time {
+	result := t.Truncate(interval)
+	if result.Before(t) {
+		result = result.Add(interval)
+	}
+	return result
+}
+
+func hourOfDay(assetId, metric string, t time.Time) float64 {
+	return float64(t.UTC().Hour())
+}
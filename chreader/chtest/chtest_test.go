@@ -0,0 +1,150 @@
+package chtest_test
+
+import (
+	"context"
+	"github.com/Symantec/uhura/chreader"
+	"github.com/Symantec/uhura/chreader/chtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	kApiKey  = "secret"
+	kAssetId = "arn:aws:ec2:us-east-1:123456789012:instance/i-12345678"
+)
+
+var (
+	kMidnight = time.Date(2017, 6, 20, 0, 0, 0, 0, time.UTC)
+	kNow      = kMidnight.Add(12 * time.Hour)
+)
+
+func TestServer(t *testing.T) {
+	Convey("With fake CloudHealth server", t, func() {
+		options := chtest.Options{
+			ApiKey:   kApiKey,
+			Assets:   []string{kAssetId},
+			PageSize: 10,
+			Now:      kNow,
+		}
+		var server *chtest.Server
+		// newReader starts the server and returns a reader using it
+		// through real HTTP with a client clock at clientNow.
+		newReader := func(
+			clientNow time.Time, retry chreader.RetryPolicy) chreader.Reader {
+			server = chtest.NewServer(options)
+			return chreader.NewCustomReader(
+				chreader.Config{ApiKey: kApiKey, BaseUrl: server.URL},
+				chreader.NewRetryingCH(chreader.DefaultCH, retry),
+				func() time.Time {
+					return clientNow
+				})
+		}
+		noRetries := chreader.RetryPolicy{MaxAttempts: 1}
+		Convey("Pages through yesterday and today", func() {
+			reader := newReader(kNow, noRetries)
+			defer server.Close()
+			entries, err := reader.Read(
+				kAssetId, kMidnight.Add(-5*time.Hour), kNow)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 17)
+			So(entries[0].Time, ShouldResemble, kMidnight.Add(-5*time.Hour))
+			So(entries[16].Time, ShouldResemble, kNow.Add(-time.Hour))
+			So(entries[16].Values["cpu:used"], ShouldEqual, 11.0)
+			// 3 pages of yesterday, 2 pages of today
+			So(server.Requests(), ShouldHaveLength, 5)
+		})
+		Convey("Several assets at once", func() {
+			options.Assets = []string{"a", "b"}
+			server = chtest.NewServer(options)
+			defer server.Close()
+			reader := chreader.NewCustomReader(
+				chreader.Config{
+					ApiKey:              kApiKey,
+					BaseUrl:             server.URL,
+					MaxAssetsPerRequest: 2,
+				},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				})
+			results := chreader.ReadMany(
+				context.Background(),
+				reader,
+				[]string{"a", "b"},
+				kMidnight.Add(time.Hour),
+				kMidnight.Add(3*time.Hour))
+			for _, result := range results {
+				So(result.Err, ShouldBeNil)
+				So(result.Entries, ShouldHaveLength, 2)
+			}
+		})
+		Convey("Server clock ahead of client", func() {
+			// The client still thinks it is yesterday.
+			reader := newReader(kMidnight.Add(-time.Hour), noRetries)
+			defer server.Close()
+			entries, err := reader.Read(
+				kAssetId, kMidnight.Add(-3*time.Hour), kMidnight)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 3)
+		})
+		Convey("Day changes mid read", func() {
+			options.Now = kMidnight.Add(-time.Second)
+			options.Step = time.Second
+			reader := newReader(kMidnight.Add(-time.Second), noRetries)
+			defer server.Close()
+			entries, err := reader.Read(
+				kAssetId, kMidnight.Add(-30*time.Hour), kMidnight)
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 30)
+		})
+		Convey("Injected errors", func() {
+			reader := newReader(kNow, noRetries)
+			defer server.Close()
+			server.Fail("10", http.StatusTooManyRequests)
+			_, err := reader.Read(kAssetId, kMidnight, kNow)
+			So(chreader.IsRateLimited(err), ShouldBeTrue)
+			_, err = reader.Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+		})
+		Convey("Injected errors get retried", func() {
+			reader := newReader(
+				kNow,
+				chreader.RetryPolicy{
+					MaxAttempts:    3,
+					InitialBackoff: time.Millisecond,
+				})
+			defer server.Close()
+			server.Fail(
+				"", http.StatusServiceUnavailable, http.StatusBadGateway)
+			_, err := reader.Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+		})
+		Convey("Unknown assets and bad API keys", func() {
+			reader := newReader(kNow, noRetries)
+			defer server.Close()
+			_, err := reader.Read("unknown", kMidnight, kNow)
+			So(chreader.IsNotFound(err), ShouldBeTrue)
+			badReader := chreader.NewCustomReader(
+				chreader.Config{ApiKey: "wrong", BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				})
+			_, err = badReader.Read(kAssetId, kMidnight, kNow)
+			So(chreader.IsUnauthorized(err), ShouldBeTrue)
+		})
+		Convey("Latency", func() {
+			options.Latency = time.Second
+			reader := newReader(kNow, noRetries)
+			defer server.Close()
+			ctx, cancel := context.WithTimeout(
+				context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := chreader.ReadContext(
+				ctx, reader, kAssetId, kMidnight, kNow)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+	})
+}
@@ -0,0 +1,210 @@
+package chreader
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	kCoalescedReadCount  int64
+	kCoalescedFetchCount int64
+)
+
+// flightType represents a call in progress.
+type flightType struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// flightGroupType lets concurrent callers with the same key share the
+// result of one call.
+type flightGroupType struct {
+	mu      sync.Mutex
+	flights map[interface{}]*flightType
+	waiting int // callers waiting for another caller's call
+}
+
+// Do calls fn with ctx and returns its result unless a call with the same
+// key is already in progress in which case Do waits for and returns the
+// result of that call instead. shared is true if the result came from
+// another caller's call. Since calls in progress use their caller's context,
+// Do calls fn again if the call it waited for was cancelled but ctx is
+// still good.
+func (g *flightGroupType) Do(
+	ctx context.Context,
+	key interface{},
+	fn func(ctx context.Context) (interface{}, error)) (
+	value interface{}, err error, shared bool) {
+	for {
+		g.mu.Lock()
+		if g.flights == nil {
+			g.flights = make(map[interface{}]*flightType)
+		}
+		flight, ok := g.flights[key]
+		if !ok {
+			flight = &flightType{done: make(chan struct{})}
+			g.flights[key] = flight
+			g.mu.Unlock()
+			g.call(ctx, key, flight, fn)
+			return flight.value, flight.err, false
+		}
+		g.waiting++
+		g.mu.Unlock()
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+		}
+		g.mu.Lock()
+		g.waiting--
+		g.mu.Unlock()
+		select {
+		case <-flight.done:
+		default:
+			return nil, ctx.Err(), false
+		}
+		if (flight.err == context.Canceled ||
+			flight.err == context.DeadlineExceeded) && ctx.Err() == nil {
+			continue
+		}
+		return flight.value, flight.err, true
+	}
+}
+
+// call calls fn for flight and then lets the callers waiting for flight
+// go. If fn panics, the waiting callers get an error, and the panic goes
+// on in the caller of call.
+func (g *flightGroupType) call(
+	ctx context.Context,
+	key interface{},
+	flight *flightType,
+	fn func(ctx context.Context) (interface{}, error)) {
+	returned := false
+	defer func() {
+		if returned {
+			return
+		}
+		r := recover()
+		flight.value = nil
+		flight.err = fmt.Errorf("chreader: Coalesced call didn't return: %v", r)
+		g.finish(key, flight)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	flight.value, flight.err = fn(ctx)
+	returned = true
+	g.finish(key, flight)
+}
+
+// finish lets later callers with key make a new call and lets the callers
+// waiting for flight go.
+func (g *flightGroupType) finish(key interface{}, flight *flightType) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(flight.done)
+}
+
+// Waiting returns how many callers are waiting for another caller's call.
+func (g *flightGroupType) Waiting() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.waiting
+}
+
+type coalescingReaderType struct {
+	r     Reader
+	group flightGroupType
+}
+
+func (c *coalescingReaderType) Read(assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	return c.ReadContext(context.Background(), assetId, start, end)
+}
+
+func (c *coalescingReaderType) granularity(ctx context.Context) string {
+	return granularityFor(ctx, c.r)
+}
+
+func (c *coalescingReaderType) ReadMetaData(
+	ctx context.Context, assetId string) (*MetaData, error) {
+	return readMetaData(ctx, c.r, assetId)
+}
+
+func (c *coalescingReaderType) ReadContext(
+	ctx context.Context, assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	start = start.UTC()
+	end = end.UTC()
+	key := memoizedReaderKeyType{
+		AssetId:     assetId,
+		Granularity: c.granularity(ctx),
+		Start:       start,
+		End:         end}
+	value, err, shared := c.group.Do(
+		ctx,
+		key,
+		func(ctx context.Context) (interface{}, error) {
+			return ReadContext(ctx, c.r, assetId, start, end)
+		})
+	if err != nil {
+		return nil, err
+	}
+	result := value.([]*Entry)
+	if !shared {
+		return result, nil
+	}
+	atomic.AddInt64(&kCoalescedReadCount, 1)
+	// Each caller gets their own slice
+	resultCopy := make([]*Entry, len(result))
+	copy(resultCopy, result)
+	return resultCopy, nil
+}
+
+func (c *coalescingReaderType) ReadMany(
+	assetIds []string, start, end time.Time) []*BatchResult {
+	return c.ReadManyContext(context.Background(), assetIds, start, end)
+}
+
+// ReadManyContext passes batches straight to c.r. Only single reads get
+// coalesced.
+func (c *coalescingReaderType) ReadManyContext(
+	ctx context.Context, assetIds []string, start, end time.Time) []*BatchResult {
+	return readMany(ctx, c.r, assetIds, start, end)
+}
+
+type coalescingCHType struct {
+	ch    CH
+	group flightGroupType
+}
+
+func (c *coalescingCHType) Fetch(url string) (*CHResult, error) {
+	return c.FetchContext(context.Background(), url)
+}
+
+func (c *coalescingCHType) FetchContext(ctx context.Context, url string) (
+	*CHResult, error) {
+	value, err, shared := c.group.Do(
+		ctx,
+		url,
+		func(ctx context.Context) (interface{}, error) {
+			return FetchContext(ctx, c.ch, url)
+		})
+	if err != nil {
+		return nil, err
+	}
+	result := value.(*CHResult)
+	if !shared {
+		return result, nil
+	}
+	atomic.AddInt64(&kCoalescedFetchCount, 1)
+	// Each caller gets their own copy
+	resultCopy := *result
+	resultCopy.Entries = make([]*Entry, len(result.Entries))
+	copy(resultCopy.Entries, result.Entries)
+	return &resultCopy, nil
+}
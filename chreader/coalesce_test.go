@@ -0,0 +1,158 @@
+package chreader_test
+
+import (
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingReaderType blocks reads until Release is closed.
+type blockingReaderType struct {
+	Release  chan struct{}
+	UseCount int32
+}
+
+func (r *blockingReaderType) Read(
+	assetId string, start, end time.Time) ([]*chreader.Entry, error) {
+	atomic.AddInt32(&r.UseCount, 1)
+	<-r.Release
+	return (&fakeReaderType{}).Read(assetId, start, end)
+}
+
+// blockingCHType blocks fetches until Release is closed.
+type blockingCHType struct {
+	Release   chan struct{}
+	CallCount int32
+}
+
+func (ch *blockingCHType) Fetch(url string) (*chreader.CHResult, error) {
+	atomic.AddInt32(&ch.CallCount, 1)
+	<-ch.Release
+	return &chreader.CHResult{
+		Entries: []*chreader.Entry{{Time: kNow}},
+		Date:    url,
+	}, nil
+}
+
+// panickingCHType panics on the first fetch once Release is closed.
+type panickingCHType struct {
+	Release   chan struct{}
+	CallCount int32
+}
+
+func (ch *panickingCHType) Fetch(url string) (*chreader.CHResult, error) {
+	callCount := atomic.AddInt32(&ch.CallCount, 1)
+	<-ch.Release
+	if callCount == 1 {
+		panic("first fetch")
+	}
+	return &chreader.CHResult{Date: url}, nil
+}
+
+// waitUntil waits until condition is true.
+func waitUntil(condition func() bool) {
+	for !condition() {
+		runtime.Gosched()
+	}
+}
+
+func TestCoalescingReader(t *testing.T) {
+	Convey("With blocking reader", t, func() {
+		blockingReader := &blockingReaderType{Release: make(chan struct{})}
+		reader := chreader.NewCoalescingReader(blockingReader)
+		results := make([][]*chreader.Entry, 5)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assetId := "instance"
+				if i == 4 {
+					assetId = "different_instance"
+				}
+				results[i], _ = reader.Read(
+					assetId, kNow.Add(-3*time.Hour), kNow)
+			}(i)
+		}
+		// Both reads started and the other 3 waiting for the first one
+		waitUntil(func() bool {
+			return atomic.LoadInt32(&blockingReader.UseCount) == 2 &&
+				chreader.CoalescingWaiting(reader) == 3
+		})
+		close(blockingReader.Release)
+		wg.Wait()
+		// One read for "instance", one for "different_instance"
+		So(blockingReader.UseCount, ShouldEqual, 2)
+		for i := 0; i < 4; i++ {
+			So(results[i], ShouldHaveLength, 3)
+			So(results[i], ShouldResemble, results[0])
+		}
+		So(results[4][0].Values, ShouldContainKey, "different_instance")
+	})
+}
+
+func TestCoalescingCH(t *testing.T) {
+	Convey("With blocking CH", t, func() {
+		blockingCh := &blockingCHType{Release: make(chan struct{})}
+		ch := chreader.NewCoalescingCH(blockingCh)
+		results := make([]*chreader.CHResult, 5)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i], _ = ch.Fetch("url")
+			}(i)
+		}
+		waitUntil(func() bool {
+			return atomic.LoadInt32(&blockingCh.CallCount) == 1 &&
+				chreader.CoalescingWaiting(ch) == 4
+		})
+		close(blockingCh.Release)
+		wg.Wait()
+		So(blockingCh.CallCount, ShouldEqual, 1)
+		for _, result := range results {
+			So(result, ShouldResemble, results[0])
+		}
+		// Later calls fetch again
+		ch.Fetch("url")
+		So(blockingCh.CallCount, ShouldEqual, 2)
+	})
+	Convey("Panics don't strand waiting callers", t, func() {
+		panickingCh := &panickingCHType{Release: make(chan struct{})}
+		ch := chreader.NewCoalescingCH(panickingCh)
+		var panics, errs int32
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() {
+					if recover() != nil {
+						atomic.AddInt32(&panics, 1)
+					}
+				}()
+				if _, err := ch.Fetch("url"); err != nil {
+					atomic.AddInt32(&errs, 1)
+				}
+			}()
+		}
+		waitUntil(func() bool {
+			return atomic.LoadInt32(&panickingCh.CallCount) == 1 &&
+				chreader.CoalescingWaiting(ch) == 2
+		})
+		close(panickingCh.Release)
+		wg.Wait()
+		So(panics, ShouldEqual, 1)
+		So(errs, ShouldEqual, 2)
+		// Later calls fetch again
+		result, err := ch.Fetch("url")
+		So(err, ShouldBeNil)
+		So(result.Date, ShouldEqual, "url")
+		So(panickingCh.CallCount, ShouldEqual, 2)
+	})
+}
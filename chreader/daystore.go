@@ -0,0 +1,305 @@
+package chreader
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultDiskCacheMaxBytes = 1024 * 1024 * 1024
+	kDefaultDaySettleTime     = 6 * time.Hour
+	kDayFileSuffix            = ".gob.gz"
+	kDayFormat                = "2006-01-02"
+	kTempFilePrefix           = ".tmp"
+	// Temporary files older than this are left from writes that didn't
+	// finish. Younger ones may belong to writes still going on.
+	kTempFileMaxAge = time.Hour
+)
+
+var (
+	kDiskDayStoresMu sync.Mutex
+	// Disk day stores by directory
+	kDiskDayStores = make(map[string]*diskDayStoreType)
+)
+
+// dayBlockType is what gets stored on disk for one asset on one day.
+// Values are stored by column to keep metric names from repeating.
+type dayBlockType struct {
+	AssetId string
+	// Names of the metrics
+	Keys []string
+	// Times in seconds since epoch
+	Times []int64
+	// Values[i][j] is the value of Keys[i] at Times[j]. NaN means no value.
+	Values [][]float64
+}
+
+func newDayBlock(assetId string, entries []*Entry) *dayBlockType {
+	keyIdxs := make(map[string]int)
+	result := &dayBlockType{
+		AssetId: assetId,
+		Times:   make([]int64, len(entries)),
+	}
+	for j, entry := range entries {
+		result.Times[j] = entry.Time.Unix()
+		for key, value := range entry.Values {
+			idx, ok := keyIdxs[key]
+			if !ok {
+				idx = len(result.Keys)
+				keyIdxs[key] = idx
+				result.Keys = append(result.Keys, key)
+				column := make([]float64, len(entries))
+				for k := range column {
+					column[k] = math.NaN()
+				}
+				result.Values = append(result.Values, column)
+			}
+			result.Values[idx][j] = value
+		}
+	}
+	return result
+}
+
+func (b *dayBlockType) Entries() []*Entry {
+	result := make([]*Entry, len(b.Times))
+	for j, ts := range b.Times {
+		entry := &Entry{
+			Time:   time.Unix(ts, 0).UTC(),
+			Values: make(map[string]float64),
+		}
+		for i, key := range b.Keys {
+			if value := b.Values[i][j]; !math.IsNaN(value) {
+				entry.Values[key] = value
+			}
+		}
+		result[j] = entry
+	}
+	return result
+}
+
+type dayFileType struct {
+	Path string
+	Day  string // like "2006-01-02"
+	Size int64
+}
+
+// diskDayStoreType stores each day for each asset in its own file.
+// dir/<hash of asset id>/<day>.gob.gz
+type diskDayStoreType struct {
+	dir      string
+	maxBytes int64
+
+	mu        sync.Mutex
+	files     map[string]*dayFileType // by path
+	totalSize int64
+}
+
+func newDiskDayStore(dir string, maxBytes int64) (*diskDayStoreType, error) {
+	if maxBytes <= 0 {
+		maxBytes = kDefaultDiskCacheMaxBytes
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	result := &diskDayStoreType{
+		dir:      dir,
+		maxBytes: maxBytes,
+		files:    make(map[string]*dayFileType),
+	}
+	err := filepath.Walk(
+		dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			// Left behind by a write that didn't finish
+			if strings.HasPrefix(info.Name(), kTempFilePrefix) {
+				if time.Since(info.ModTime()) > kTempFileMaxAge {
+					os.Remove(path)
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, kDayFileSuffix) {
+				return nil
+			}
+			result.add(&dayFileType{
+				Path: path,
+				Day:  strings.TrimSuffix(filepath.Base(path), kDayFileSuffix),
+				Size: info.Size(),
+			})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	result.mu.Lock()
+	defer result.mu.Unlock()
+	result.evict()
+	return result, nil
+}
+
+// sharedDiskDayStore returns the disk day store for dir creating it if
+// needed. Readers share one store per directory so that the size of the
+// directory is counted once. The store keeps the latest maxBytes.
+func sharedDiskDayStore(dir string, maxBytes int64) (
+	*diskDayStoreType, error) {
+	dir = filepath.Clean(dir)
+	kDiskDayStoresMu.Lock()
+	defer kDiskDayStoresMu.Unlock()
+	if result, ok := kDiskDayStores[dir]; ok {
+		result.setMaxBytes(maxBytes)
+		return result, nil
+	}
+	result, err := newDiskDayStore(dir, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	kDiskDayStores[dir] = result
+	return result, nil
+}
+
+func (s *diskDayStoreType) setMaxBytes(maxBytes int64) {
+	if maxBytes <= 0 {
+		maxBytes = kDefaultDiskCacheMaxBytes
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxBytes = maxBytes
+	s.evict()
+}
+
+func (s *diskDayStoreType) Get(assetId string, day time.Time) (
+	[]*Entry, bool) {
+	block, err := s.read(s.path(assetId, day))
+	if err != nil || block.AssetId != assetId {
+		return nil, false
+	}
+	return block.Entries(), true
+}
+
+func (s *diskDayStoreType) Put(
+	assetId string, day time.Time, entries []*Entry) error {
+	path := s.path(assetId, day)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	size, err := s.write(path, newDayBlock(assetId, entries))
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(&dayFileType{
+		Path: path,
+		Day:  day.UTC().Format(kDayFormat),
+		Size: size,
+	})
+	s.evict()
+	return nil
+}
+
+func (s *diskDayStoreType) path(assetId string, day time.Time) string {
+	hash := sha1.Sum([]byte(assetId))
+	return filepath.Join(
+		s.dir,
+		hex.EncodeToString(hash[:]),
+		day.UTC().Format(kDayFormat)+kDayFileSuffix)
+}
+
+func (s *diskDayStoreType) read(path string) (*dayBlockType, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	var result dayBlockType
+	if err := gob.NewDecoder(reader).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// write writes block to path and returns the size of the file written.
+// write writes to a temporary file first so that readers never see
+// a partially written file.
+func (s *diskDayStoreType) write(path string, block *dayBlockType) (
+	int64, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), kTempFilePrefix)
+	if err != nil {
+		return 0, err
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
+	writer := gzip.NewWriter(file)
+	if err := gob.NewEncoder(writer).Encode(block); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		file.Close()
+		return 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// add records file. Caller must hold the lock.
+func (s *diskDayStoreType) add(file *dayFileType) {
+	if old, ok := s.files[file.Path]; ok {
+		s.totalSize -= old.Size
+	}
+	s.files[file.Path] = file
+	s.totalSize += file.Size
+}
+
+// evict removes the files for the oldest days until the total size is
+// within the limit. Caller must hold the lock.
+func (s *diskDayStoreType) evict() {
+	if s.totalSize <= s.maxBytes {
+		return
+	}
+	files := make([]*dayFileType, 0, len(s.files))
+	for _, file := range s.files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Day < files[j].Day
+	})
+	for _, file := range files {
+		if s.totalSize <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(file.Path); err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		delete(s.files, file.Path)
+		s.totalSize -= file.Size
+	}
+}
@@ -0,0 +1,271 @@
+package chreader_test
+
+import (
+	"github.com/Symantec/uhura/chreader"
+	"github.com/Symantec/uhura/chreader/chtest"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func dayOfEntries(day time.Time) []*chreader.Entry {
+	var result []*chreader.Entry
+	for ts := day; ts.Before(day.Add(24 * time.Hour)); ts = ts.Add(time.Hour) {
+		entry := &chreader.Entry{
+			Time: ts,
+			Values: map[string]float64{
+				"cpu:used": float64(ts.Unix()),
+			},
+		}
+		if ts.Hour()%2 == 0 {
+			entry.Values["cpu:even"] = 2.5
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(dir string) (result int64) {
+	filepath.Walk(
+		dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				result += info.Size()
+			}
+			return nil
+		})
+	return
+}
+
+func TestDiskDayStore(t *testing.T) {
+	Convey("With temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "daystore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store, err := chreader.NewDiskDayStore(dir, 0)
+		So(err, ShouldBeNil)
+		day := kMidnight.Add(-48 * time.Hour)
+		So(store.Put(kAssetId, day, dayOfEntries(day)), ShouldBeNil)
+		Convey("Stored days come back", func() {
+			entries, ok := store.Get(kAssetId, day)
+			So(ok, ShouldBeTrue)
+			So(entries, ShouldResemble, dayOfEntries(day))
+		})
+		Convey("Other days and assets missing", func() {
+			_, ok := store.Get(kAssetId, day.Add(24*time.Hour))
+			So(ok, ShouldBeFalse)
+			_, ok = store.Get("anotherAssetId", day)
+			So(ok, ShouldBeFalse)
+		})
+		Convey("Empty days can be stored", func() {
+			emptyDay := day.Add(-24 * time.Hour)
+			So(store.Put(kAssetId, emptyDay, nil), ShouldBeNil)
+			entries, ok := store.Get(kAssetId, emptyDay)
+			So(ok, ShouldBeTrue)
+			So(entries, ShouldBeEmpty)
+		})
+		Convey("Stored days survive reopening", func() {
+			reopened, err := chreader.NewDiskDayStore(dir, 0)
+			So(err, ShouldBeNil)
+			entries, ok := reopened.Get(kAssetId, day)
+			So(ok, ShouldBeTrue)
+			So(entries, ShouldResemble, dayOfEntries(day))
+		})
+		Convey("Old temporary files removed on reopening", func() {
+			oldFile, err := ioutil.TempFile(dir, ".tmp")
+			So(err, ShouldBeNil)
+			oldFile.Close()
+			longAgo := time.Now().Add(-2 * time.Hour)
+			So(os.Chtimes(oldFile.Name(), longAgo, longAgo), ShouldBeNil)
+			// Could be a write still going on
+			newFile, err := ioutil.TempFile(dir, ".tmp")
+			So(err, ShouldBeNil)
+			newFile.Close()
+			_, err = chreader.NewDiskDayStore(dir, 0)
+			So(err, ShouldBeNil)
+			_, err = os.Stat(oldFile.Name())
+			So(os.IsNotExist(err), ShouldBeTrue)
+			_, err = os.Stat(newFile.Name())
+			So(err, ShouldBeNil)
+			_, ok := store.Get(kAssetId, day)
+			So(ok, ShouldBeTrue)
+		})
+		Convey("Oldest days evicted first", func() {
+			smallStore, err := chreader.NewDiskDayStore(dir, 1)
+			So(err, ShouldBeNil)
+			// Even one day doesn't fit
+			_, ok := smallStore.Get(kAssetId, day)
+			So(ok, ShouldBeFalse)
+			newerDay := day.Add(24 * time.Hour)
+			So(store.Put(kAssetId, newerDay, dayOfEntries(newerDay)), ShouldBeNil)
+			daySize := dirSize(dir)
+			So(daySize, ShouldBeGreaterThan, 0)
+			smallStore, err = chreader.NewDiskDayStore(dir, daySize*3/2)
+			So(err, ShouldBeNil)
+			olderDay := day.Add(-24 * time.Hour)
+			So(smallStore.Put(kAssetId, olderDay, dayOfEntries(olderDay)), ShouldBeNil)
+			_, ok = smallStore.Get(kAssetId, olderDay)
+			So(ok, ShouldBeFalse)
+			_, ok = smallStore.Get(kAssetId, newerDay)
+			So(ok, ShouldBeTrue)
+		})
+	})
+}
+
+func TestSharedDiskCache(t *testing.T) {
+	Convey("Readers with the same disk cache share its size", t, func() {
+		dir, err := ioutil.TempDir("", "daystore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		server := chtest.NewServer(chtest.Options{})
+		defer server.Close()
+		newReader := func(maxBytes int64) chreader.Reader {
+			reader, err := chreader.NewCheckedReader(chreader.Config{
+				ApiKey:            kApiKey,
+				BaseUrl:           server.URL,
+				DiskCacheDir:      dir,
+				DiskCacheMaxBytes: maxBytes,
+			})
+			So(err, ShouldBeNil)
+			return reader
+		}
+		midnight := time.Now().UTC().Truncate(24 * time.Hour)
+		readDaysAgo := func(reader chreader.Reader, days int) {
+			start := midnight.Add(time.Duration(-days) * 24 * time.Hour)
+			_, err := reader.Read(kAssetId, start, start.Add(24*time.Hour))
+			So(err, ShouldBeNil)
+		}
+		readDaysAgo(newReader(0), 4)
+		daySize := dirSize(dir)
+		So(daySize, ShouldBeGreaterThan, 0)
+		// Room for one day only
+		second := newReader(daySize * 3 / 2)
+		third := newReader(daySize * 3 / 2)
+		readDaysAgo(second, 3)
+		readDaysAgo(third, 2)
+		So(dirSize(dir), ShouldBeLessThanOrEqualTo, daySize*3/2)
+	})
+}
+
+func TestReaderWithDayStore(t *testing.T) {
+	Convey("With fake cloudhealth and temporary directory", t, func() {
+		dir, err := ioutil.TempDir("", "daystore")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		store, err := chreader.NewDiskDayStore(dir, 0)
+		So(err, ShouldBeNil)
+		fakeCh := &fakeCHType{
+			CurrentTime: kNow,
+			ApiKey:      kApiKey,
+			AssetId:     kAssetId}
+		reader := chreader.NewCustomReaderWithDayStore(
+			chreader.Config{
+				ApiKey: kApiKey,
+			},
+			fakeCh,
+			func() time.Time {
+				return kNow
+			},
+			store,
+		)
+		Convey("Past days come from store the second time", func() {
+			entries, err := reader.Read(
+				kAssetId,
+				kMidnight.Add(-40*time.Hour),
+				kMidnight.Add(-30*time.Hour))
+			So(err, ShouldBeNil)
+			So(
+				entries,
+				shouldHaveRange,
+				kMidnight.Add(-40*time.Hour),
+				kMidnight.Add(-30*time.Hour))
+			So(fakeCh.CallCount, ShouldEqual, 1)
+			entries, err = reader.Read(
+				kAssetId,
+				kMidnight.Add(-48*time.Hour),
+				kMidnight.Add(-24*time.Hour))
+			So(err, ShouldBeNil)
+			So(
+				entries,
+				shouldHaveRange,
+				kMidnight.Add(-48*time.Hour),
+				kMidnight.Add(-24*time.Hour))
+			So(fakeCh.CallCount, ShouldEqual, 1)
+		})
+		Convey("Only today fetched when past days stored", func() {
+			_, err := reader.Read(
+				kAssetId, kMidnight.Add(-30*time.Hour), kMidnight)
+			So(err, ShouldBeNil)
+			// "last_2_days" then "today" since nothing came after the end
+			So(fakeCh.CallCount, ShouldEqual, 2)
+			entries, err := reader.Read(
+				kAssetId,
+				kMidnight.Add(-30*time.Hour),
+				kMidnight.Add(3*time.Hour))
+			So(err, ShouldBeNil)
+			So(
+				entries,
+				shouldHaveRange,
+				kMidnight.Add(-30*time.Hour),
+				kMidnight.Add(3*time.Hour))
+			So(fakeCh.CallCount, ShouldEqual, 3)
+		})
+		Convey("Empty days not stored", func() {
+			countingCh := &countingCHType{}
+			emptyReader := chreader.NewCustomReaderWithDayStore(
+				chreader.Config{ApiKey: kApiKey},
+				countingCh,
+				func() time.Time {
+					return kNow
+				},
+				store,
+			)
+			day := kMidnight.Add(-48 * time.Hour)
+			entries, err := emptyReader.Read(
+				kAssetId, day, day.Add(24*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, ShouldBeEmpty)
+			_, ok := store.Get(kAssetId, day)
+			So(ok, ShouldBeFalse)
+			callCount := countingCh.CallCount
+			_, err = emptyReader.Read(kAssetId, day, day.Add(24*time.Hour))
+			So(err, ShouldBeNil)
+			So(countingCh.CallCount, ShouldBeGreaterThan, callCount)
+		})
+		Convey("Days not settled yet not stored", func() {
+			now := kMidnight.Add(time.Hour)
+			fakeCh.CurrentTime = now
+			earlyReader := chreader.NewCustomReaderWithDayStore(
+				chreader.Config{ApiKey: kApiKey},
+				fakeCh,
+				func() time.Time {
+					return now
+				},
+				store,
+			)
+			yesterday := kMidnight.Add(-24 * time.Hour)
+			_, err := earlyReader.Read(kAssetId, yesterday, kMidnight)
+			So(err, ShouldBeNil)
+			_, ok := store.Get(kAssetId, yesterday)
+			So(ok, ShouldBeFalse)
+			now = kNow
+			fakeCh.CurrentTime = now
+			_, err = earlyReader.Read(kAssetId, yesterday, kMidnight)
+			So(err, ShouldBeNil)
+			_, ok = store.Get(kAssetId, yesterday)
+			So(ok, ShouldBeTrue)
+		})
+		Convey("Days not over on cloudhealth server not stored", func() {
+			fakeCh.CurrentTime = kMidnight.Add(-time.Minute)
+			_, err := reader.Read(
+				kAssetId, kMidnight.Add(-24*time.Hour), kMidnight)
+			So(err, ShouldBeNil)
+			_, ok := store.Get(kAssetId, kMidnight.Add(-24*time.Hour))
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,14 @@
+package chreader
+
+// CoalescingWaiting returns how many callers of c, a reader from
+// NewCoalescingReader or a CH from NewCoalescingCH, are waiting for
+// another caller's call.
+func CoalescingWaiting(c interface{}) int {
+	switch coalescing := c.(type) {
+	case *coalescingReaderType:
+		return coalescing.group.Waiting()
+	case *coalescingCHType:
+		return coalescing.group.Waiting()
+	}
+	panic("Not coalescing")
+}
@@ -0,0 +1,214 @@
+package chreader
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	kFixtureSuffix = ".json"
+)
+
+// fixtureType is one CloudHealth result saved to disk. URLs have the API
+// key redacted.
+type fixtureType struct {
+	Url      string
+	Date     string     `json:",omitempty"`
+	Next     string     `json:",omitempty"`
+	Datasets []*Dataset `json:",omitempty"`
+	// Saved only when there are no datasets
+	Entries []*Entry  `json:",omitempty"`
+	Error   *APIError `json:",omitempty"`
+}
+
+func newFixture(url string, result *CHResult, err error) *fixtureType {
+	fixture := &fixtureType{Url: redactUrl(url)}
+	if err != nil {
+		fixture.Error = err.(*APIError)
+		return fixture
+	}
+	fixture.Date = result.Date
+	if result.Next != "" {
+		fixture.Next = redactUrl(result.Next)
+	}
+	fixture.Datasets = result.Datasets
+	if len(result.Datasets) == 0 {
+		fixture.Entries = result.Entries
+	}
+	return fixture
+}
+
+func (f *fixtureType) Result() (*CHResult, error) {
+	if f.Error != nil {
+		apiErr := *f.Error
+		return nil, &apiErr
+	}
+	result := &CHResult{
+		Date:     f.Date,
+		Next:     f.Next,
+		Datasets: f.Datasets,
+		Entries:  f.Entries,
+	}
+	if len(f.Datasets) != 0 {
+		result.Entries = allEntries(f.Datasets)
+	}
+	return result, nil
+}
+
+// fixtureKey returns the key of the fixtures for url. Fixtures for the
+// same URL with different API keys share the same key.
+func fixtureKey(url string) string {
+	hash := sha1.Sum([]byte(redactUrl(url)))
+	return hex.EncodeToString(hash[:])
+}
+
+// fixturePath returns the path in dir of fixture number seq for key.
+// Numbers start at 1.
+func fixturePath(dir, key string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%d%s", key, seq, kFixtureSuffix))
+}
+
+// fixtureCount returns how many fixtures dir has for key.
+func fixtureCount(dir, key string) (int, error) {
+	paths, err := filepath.Glob(
+		filepath.Join(dir, key+"-*"+kFixtureSuffix))
+	if err != nil {
+		return 0, err
+	}
+	return len(paths), nil
+}
+
+type recordingCHType struct {
+	ch  CH
+	dir string
+
+	mu     sync.Mutex
+	counts map[string]int // Fixtures for each key so far
+}
+
+func newRecordingCH(ch CH, dir string) (*recordingCHType, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recordingCHType{
+		ch: ch, dir: dir, counts: make(map[string]int)}, nil
+}
+
+func (r *recordingCHType) Fetch(url string) (*CHResult, error) {
+	return r.FetchContext(context.Background(), url)
+}
+
+func (r *recordingCHType) FetchContext(ctx context.Context, url string) (
+	*CHResult, error) {
+	result, err := FetchContext(ctx, r.ch, url)
+	var apiErr *APIError
+	if err != nil && !errors.As(err, &apiErr) {
+		return nil, err
+	}
+	if apiErr != nil {
+		err = apiErr
+	}
+	if saveErr := r.save(url, newFixture(url, result, err)); saveErr != nil {
+		return nil, saveErr
+	}
+	return result, err
+}
+
+// nextSeq returns the number of the next fixture for key. Recording
+// continues after the fixtures already in r.dir.
+func (r *recordingCHType) nextSeq(key string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count, ok := r.counts[key]
+	if !ok {
+		var err error
+		if count, err = fixtureCount(r.dir, key); err != nil {
+			return 0, err
+		}
+	}
+	count++
+	r.counts[key] = count
+	return count, nil
+}
+
+// save writes fixture to a temporary file first so that replaying CHs
+// never see a partially written fixture.
+func (r *recordingCHType) save(url string, fixture *fixtureType) error {
+	key := fixtureKey(url)
+	seq, err := r.nextSeq(key)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(fixture, "", "\t")
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(r.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+	defer os.Remove(tempPath)
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, fixturePath(r.dir, key, seq))
+}
+
+type replayCHType struct {
+	dir string
+
+	mu     sync.Mutex
+	served map[string]int // Fixtures served for each key so far
+}
+
+func newReplayCH(dir string) *replayCHType {
+	return &replayCHType{dir: dir, served: make(map[string]int)}
+}
+
+func (r *replayCHType) Fetch(url string) (*CHResult, error) {
+	fixture, err := r.next(url)
+	if err != nil {
+		return nil, err
+	}
+	return fixture.Result()
+}
+
+// next returns the next fixture for url. Once all fixtures for url have
+// been served, next keeps returning the last one.
+func (r *replayCHType) next(url string) (*fixtureType, error) {
+	key := fixtureKey(url)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seq := r.served[key] + 1
+	content, err := ioutil.ReadFile(fixturePath(r.dir, key, seq))
+	if os.IsNotExist(err) && seq > 1 {
+		seq--
+		content, err = ioutil.ReadFile(fixturePath(r.dir, key, seq))
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf(
+			"chreader: No fixture for %s", redactUrl(url))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fixture fixtureType
+	if err := json.Unmarshal(content, &fixture); err != nil {
+		return nil, err
+	}
+	r.served[key] = seq
+	return &fixture, nil
+}
@@ -0,0 +1,134 @@
+package chreader_test
+
+import (
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sequenceCHType returns its results in order no matter the URL.
+type sequenceCHType struct {
+	Results []*chreader.CHResult
+	// Errors[i], if set, is returned instead of Results[i]
+	Errors []error
+	count  int
+}
+
+func (ch *sequenceCHType) Fetch(url string) (*chreader.CHResult, error) {
+	i := ch.count
+	ch.count++
+	if i < len(ch.Errors) && ch.Errors[i] != nil {
+		return nil, ch.Errors[i]
+	}
+	return ch.Results[i], nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	Convey("With fixture directory", t, func() {
+		dir, err := ioutil.TempDir("", "fixtures")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		now := func() time.Time {
+			return kNow
+		}
+		replayReader := chreader.NewCustomReader(
+			chreader.Config{ApiKey: "anotherKey"},
+			chreader.NewReplayCH(dir),
+			now)
+		Convey("Replay serves recorded pages", func() {
+			fakeCh := &fakeCHType{
+				CurrentTime: kNow,
+				ApiKey:      "secretKey",
+				AssetId:     kAssetId}
+			recordingCh, err := chreader.NewRecordingCH(fakeCh, dir)
+			So(err, ShouldBeNil)
+			reader := chreader.NewCustomReader(
+				chreader.Config{ApiKey: "secretKey"}, recordingCh, now)
+			start := kMidnight.Add(-7 * 24 * time.Hour)
+			_, err = reader.Read(kAssetId, start, kNow)
+			So(err, ShouldBeNil)
+			// Two pages of "last_7_days" and "today"
+			So(fakeCh.CallCount, ShouldEqual, 3)
+			entries, err := replayReader.Read(kAssetId, start, kNow)
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, start, kNow)
+			So(fakeCh.CallCount, ShouldEqual, 3)
+			Convey("Fixtures hide API key", func() {
+				files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+				So(err, ShouldBeNil)
+				So(files, ShouldHaveLength, 3)
+				for _, file := range files {
+					content, err := ioutil.ReadFile(file)
+					So(err, ShouldBeNil)
+					So(string(content), ShouldNotContainSubstring, "secretKey")
+				}
+			})
+		})
+		Convey("Replay serves recorded API errors", func() {
+			recordingCh, err := chreader.NewRecordingCH(
+				&multiAssetCHType{CurrentTime: kNow}, dir)
+			So(err, ShouldBeNil)
+			reader := chreader.NewCustomReader(
+				chreader.Config{ApiKey: kApiKey}, recordingCh, now)
+			_, err = reader.Read("unknown", kMidnight, kNow)
+			So(chreader.IsNotFound(err), ShouldBeTrue)
+			_, err = replayReader.Read("unknown", kMidnight, kNow)
+			So(chreader.IsNotFound(err), ShouldBeTrue)
+		})
+		Convey("Replay serves results for the same URL in order", func() {
+			sequenceCh := &sequenceCHType{
+				Results: []*chreader.CHResult{
+					nil,
+					{Date: "Tue, 20 Jun 2017 23:59:59 GMT"},
+					{Date: "Wed, 21 Jun 2017 00:00:01 GMT"},
+				},
+				Errors: []error{
+					&chreader.APIError{Status: 503, RetryAfter: "1"},
+				},
+			}
+			recordingCh, err := chreader.NewRecordingCH(sequenceCh, dir)
+			So(err, ShouldBeNil)
+			const url = "http://chapi.example.com/metrics/v1?api_key=secretKey"
+			for i := 0; i < 3; i++ {
+				recordingCh.Fetch(url)
+			}
+			replayCh := chreader.NewReplayCH(dir)
+			const otherKeyUrl = "http://chapi.example.com/metrics/v1?api_key=anotherKey"
+			_, err = replayCh.Fetch(otherKeyUrl)
+			So(err, ShouldResemble, &chreader.APIError{
+				Status:     503,
+				RetryAfter: "1",
+			})
+			result, err := replayCh.Fetch(otherKeyUrl)
+			So(err, ShouldBeNil)
+			So(result.Date, ShouldEqual, "Tue, 20 Jun 2017 23:59:59 GMT")
+			result, err = replayCh.Fetch(otherKeyUrl)
+			So(err, ShouldBeNil)
+			So(result.Date, ShouldEqual, "Wed, 21 Jun 2017 00:00:01 GMT")
+			// The last result once the sequence runs out
+			result, err = replayCh.Fetch(otherKeyUrl)
+			So(err, ShouldBeNil)
+			So(result.Date, ShouldEqual, "Wed, 21 Jun 2017 00:00:01 GMT")
+			Convey("Recording again continues the sequence", func() {
+				sequenceCh.Results = append(
+					sequenceCh.Results,
+					&chreader.CHResult{Date: "Wed, 21 Jun 2017 00:01:00 GMT"})
+				recordingCh, err := chreader.NewRecordingCH(sequenceCh, dir)
+				So(err, ShouldBeNil)
+				recordingCh.Fetch(url)
+				result, err := replayCh.Fetch(otherKeyUrl)
+				So(err, ShouldBeNil)
+				So(result.Date, ShouldEqual, "Wed, 21 Jun 2017 00:01:00 GMT")
+			})
+		})
+		Convey("Replay fails without fixture", func() {
+			_, err := replayReader.Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldNotContainSubstring, "anotherKey")
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package chreader
+
+import (
+	"context"
+	"fmt"
+)
+
+type granularityKeyType struct{}
+
+var (
+	kGranularityKey granularityKeyType
+)
+
+func withGranularity(ctx context.Context, granularity string) context.Context {
+	return context.WithValue(ctx, kGranularityKey, granularity)
+}
+
+func granularityOf(ctx context.Context) string {
+	granularity, _ := ctx.Value(kGranularityKey).(string)
+	return granularity
+}
+
+// checkGranularity returns an error if granularity is neither empty nor
+// one CloudHealth knows.
+func checkGranularity(granularity string) error {
+	if granularity == "" {
+		return nil
+	}
+	if _, ok := kGranularityIntervals[granularity]; !ok {
+		return fmt.Errorf("chreader: Unknown granularity '%s'", granularity)
+	}
+	return nil
+}
+
+// granularityReader is implemented by readers that know which granularity
+// they ask CloudHealth for when reading using a context.
+type granularityReader interface {
+	granularity(ctx context.Context) string
+}
+
+// granularityFor returns the granularity that r asks CloudHealth for when
+// reading using ctx. If r doesn't know, granularityFor returns the one ctx
+// asks for.
+func granularityFor(ctx context.Context, r Reader) string {
+	if gr, ok := r.(granularityReader); ok {
+		return gr.granularity(ctx)
+	}
+	return granularityOf(ctx)
+}
+
+// granularityKey returns the key under which to keep the entries for
+// assetId of the given granularity. Entries of different granularities
+// get different keys.
+func granularityKey(granularity, assetId string) string {
+	if granularity != "" {
+		return assetId + "?granularity=" + granularity
+	}
+	return assetId
+}
+
+// granularity returns the granularity to ask CloudHealth for when reading
+// using ctx.
+func (r *chReaderType) granularity(ctx context.Context) string {
+	if granularity := granularityOf(ctx); granularity != "" {
+		return granularity
+	}
+	return r.config.Granularity
+}
@@ -0,0 +1,155 @@
+package chreader_test
+
+import (
+	"context"
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// urlRecordingCHType records the granularity requested in each fetch.
+type urlRecordingCHType struct {
+	*fakeCHType
+	Granularities []string
+}
+
+func (ch *urlRecordingCHType) Fetch(rawUrl string) (
+	*chreader.CHResult, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	ch.Granularities = append(ch.Granularities, u.Query().Get("granularity"))
+	return ch.fakeCHType.Fetch(rawUrl)
+}
+
+func TestGranularity(t *testing.T) {
+	Convey("With fake cloudhealth", t, func() {
+		fakeCh := &urlRecordingCHType{
+			fakeCHType: &fakeCHType{
+				CurrentTime: kNow,
+				ApiKey:      kApiKey,
+				AssetId:     kAssetId}}
+		newReader := func(granularity string) chreader.Reader {
+			return chreader.NewCustomReader(
+				chreader.Config{
+					ApiKey:      kApiKey,
+					Granularity: granularity,
+				},
+				fakeCh,
+				func() time.Time {
+					return kNow
+				})
+		}
+		dayCtx := chreader.WithGranularity(context.Background(), "day")
+		Convey("CloudHealth default if none given", func() {
+			_, err := newReader("").Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{""})
+		})
+		Convey("Config default", func() {
+			_, err := newReader("hour").Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"hour"})
+		})
+		Convey("Context overrides config", func() {
+			So(chreader.GranularityFromContext(dayCtx), ShouldEqual, "day")
+			_, err := chreader.ReadContext(
+				dayCtx, newReader("hour"), kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"day"})
+		})
+		Convey("Unknown granularities rejected", func() {
+			_, err := chreader.ReadContext(
+				chreader.WithGranularity(context.Background(), "fortnight"),
+				newReader(""),
+				kAssetId,
+				kMidnight,
+				kNow)
+			So(err, ShouldNotBeNil)
+			So(fakeCh.Granularities, ShouldBeEmpty)
+			_, err = chreader.NewCheckedReader(
+				chreader.Config{Granularity: "fortnight"})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Caching reader keeps granularities apart", func() {
+			reader := chreader.NewCachingReader(
+				newReader(""), chreader.CachingOptions{})
+			_, err := reader.Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			_, err = chreader.ReadContext(
+				dayCtx, reader, kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			_, err = chreader.ReadContext(
+				dayCtx, reader, kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"", "day"})
+		})
+		Convey("Interval reader keeps granularities apart", func() {
+			reader := chreader.NewCustomIntervalReader(
+				newReader(""),
+				chreader.IntervalOptions{},
+				func() time.Time {
+					return kNow
+				})
+			end := kMidnight.Add(3 * time.Hour)
+			_, err := reader.Read(kAssetId, kMidnight, end)
+			So(err, ShouldBeNil)
+			_, err = chreader.ReadContext(
+				dayCtx, reader, kAssetId, kMidnight, end)
+			So(err, ShouldBeNil)
+			_, err = chreader.ReadContext(
+				dayCtx, reader, kAssetId, kMidnight, end)
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"", "day"})
+		})
+		Convey("Caching reader keys on config default", func() {
+			reader := chreader.NewCachingReader(
+				newReader("day"), chreader.CachingOptions{})
+			_, err := reader.Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			_, err = chreader.ReadContext(
+				dayCtx, reader, kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"day"})
+		})
+		Convey("Disk store keeps config granularities apart", func() {
+			dir, err := ioutil.TempDir("", "granularity")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			store, err := chreader.NewDiskDayStore(dir, 0)
+			So(err, ShouldBeNil)
+			newStoreReader := func(granularity string) chreader.Reader {
+				return chreader.NewCustomReaderWithDayStore(
+					chreader.Config{
+						ApiKey:      kApiKey,
+						Granularity: granularity,
+					},
+					fakeCh,
+					func() time.Time {
+						return kNow
+					},
+					store)
+			}
+			dayBefore := kMidnight.Add(-48 * time.Hour)
+			_, err = newStoreReader("hour").Read(
+				kAssetId, dayBefore, dayBefore.Add(24*time.Hour))
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"hour"})
+			// After a restart with a different granularity
+			_, err = newStoreReader("day").Read(
+				kAssetId, dayBefore, dayBefore.Add(24*time.Hour))
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"hour", "day"})
+			// Back to the first granularity comes from the store
+			_, err = newStoreReader("hour").Read(
+				kAssetId, dayBefore, dayBefore.Add(24*time.Hour))
+			So(err, ShouldBeNil)
+			So(fakeCh.Granularities, ShouldResemble, []string{"hour", "day"})
+		})
+	})
+}
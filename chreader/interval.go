@@ -0,0 +1,351 @@
+package chreader
+
+import (
+	"container/list"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultMaxAssets  = 1000
+	kDefaultSettleTime = time.Hour
+	kDefaultMaxAge     = 32 * 24 * time.Hour
+)
+
+// intervalType represents the time range from Start inclusive to End
+// exclusive.
+type intervalType struct {
+	Start time.Time
+	End   time.Time
+}
+
+// assetDataType holds what we know about one asset.
+type assetDataType struct {
+	AssetId string
+	// Time ranges for which Entries is complete. Sorted and never
+	// overlapping or touching.
+	Covered []intervalType
+	// Sorted by time with no two entries having the same time. May include
+	// entries outside Covered.
+	Entries []*Entry
+}
+
+type intervalReaderType struct {
+	r          Reader
+	now        func() time.Time
+	maxAssets  int
+	settleTime time.Duration
+	maxAge     time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *assetDataType, most recently used at front
+	byAsset map[string]*list.Element
+}
+
+func newIntervalReader(
+	r Reader, opts IntervalOptions, now func() time.Time) *intervalReaderType {
+	result := &intervalReaderType{
+		r:          r,
+		now:        now,
+		maxAssets:  opts.MaxAssets,
+		settleTime: opts.SettleTime,
+		maxAge:     opts.MaxAge,
+		lru:        list.New(),
+		byAsset:    make(map[string]*list.Element),
+	}
+	if result.maxAssets <= 0 {
+		result.maxAssets = kDefaultMaxAssets
+	}
+	if result.settleTime <= 0 {
+		result.settleTime = kDefaultSettleTime
+	}
+	if result.maxAge <= 0 {
+		result.maxAge = kDefaultMaxAge
+	}
+	return result
+}
+
+func (r *intervalReaderType) Read(assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	return r.ReadContext(context.Background(), assetId, start, end)
+}
+
+func (r *intervalReaderType) granularity(ctx context.Context) string {
+	return granularityFor(ctx, r.r)
+}
+
+func (r *intervalReaderType) ReadMetaData(
+	ctx context.Context, assetId string) (*MetaData, error) {
+	return readMetaData(ctx, r.r, assetId)
+}
+
+func (r *intervalReaderType) ReadContext(
+	ctx context.Context, assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	start = start.UTC()
+	end = end.UTC()
+	if !start.Before(end) {
+		return nil, nil
+	}
+	// Keep entries of different granularities apart
+	key := granularityKey(r.granularity(ctx), assetId)
+	data, gaps := r.gaps(key, start, end)
+	fetched := make([][]*Entry, len(gaps))
+	for i, gap := range gaps {
+		var err error
+		fetched[i], err = ReadContext(ctx, r.r, assetId, gap.Start, gap.End)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.merge(data, start, end, gaps, fetched), nil
+}
+
+func (r *intervalReaderType) ReadMany(
+	assetIds []string, start, end time.Time) []*BatchResult {
+	return r.ReadManyContext(context.Background(), assetIds, start, end)
+}
+
+// ReadManyContext groups the assets that are missing the same time ranges
+// so that each group needs only one batch per missing time range. Assets
+// read together tend to be read together every time, so usually there is
+// just one group.
+func (r *intervalReaderType) ReadManyContext(
+	ctx context.Context, assetIds []string, start, end time.Time) []*BatchResult {
+	start = start.UTC()
+	end = end.UTC()
+	results := make([]*BatchResult, len(assetIds))
+	if !start.Before(end) {
+		for i, assetId := range assetIds {
+			results[i] = &BatchResult{AssetId: assetId}
+		}
+		return results
+	}
+	granularity := r.granularity(ctx)
+	dataByAsset := make([]*assetDataType, len(assetIds))
+	gapsByAsset := make([][]intervalType, len(assetIds))
+	groups := make(map[string][]int)
+	var groupKeys []string
+	for i, assetId := range assetIds {
+		dataByAsset[i], gapsByAsset[i] = r.gaps(
+			granularityKey(granularity, assetId), start, end)
+		key := gapsKey(gapsByAsset[i])
+		if _, ok := groups[key]; !ok {
+			groupKeys = append(groupKeys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+	for _, key := range groupKeys {
+		idxs := groups[key]
+		gaps := gapsByAsset[idxs[0]]
+		groupIds := make([]string, len(idxs))
+		for j, i := range idxs {
+			groupIds[j] = assetIds[i]
+		}
+		fetched := make([][][]*Entry, len(idxs))
+		errs := make([]error, len(idxs))
+		for _, gap := range gaps {
+			gapResults := readMany(ctx, r.r, groupIds, gap.Start, gap.End)
+			for j, result := range gapResults {
+				if result.Err != nil {
+					errs[j] = result.Err
+				}
+				fetched[j] = append(fetched[j], result.Entries)
+			}
+		}
+		for j, i := range idxs {
+			results[i] = &BatchResult{AssetId: assetIds[i], Err: errs[j]}
+			if errs[j] == nil {
+				results[i].Entries = r.merge(
+					dataByAsset[i],
+					start,
+					end,
+					gaps,
+					fetched[j])
+			}
+		}
+	}
+	return results
+}
+
+// gapsKey returns a string that is the same for two lists of gaps only
+// if they are equal.
+func gapsKey(gaps []intervalType) string {
+	parts := make([]string, len(gaps))
+	for i, gap := range gaps {
+		parts[i] = strconv.FormatInt(gap.Start.UnixNano(), 10) + "-" +
+			strconv.FormatInt(gap.End.UnixNano(), 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// gaps returns the data for assetId along with the parts of start to end
+// not yet cached. Callers pass the returned data to merge so that what
+// gaps found covered is still there even if assetId gets evicted in
+// between.
+func (r *intervalReaderType) gaps(assetId string, start, end time.Time) (
+	data *assetDataType, result []intervalType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data = r.assetData(assetId)
+	for _, iv := range data.Covered {
+		if !iv.End.After(start) {
+			continue
+		}
+		if !iv.Start.Before(end) {
+			break
+		}
+		if iv.Start.After(start) {
+			result = append(result, intervalType{Start: start, End: iv.Start})
+		}
+		start = iv.End
+	}
+	if start.Before(end) {
+		result = append(result, intervalType{Start: start, End: end})
+	}
+	return
+}
+
+// merge stores fetched, the entries for each of gaps, in data and returns
+// all the entries between start and end.
+func (r *intervalReaderType) merge(
+	data *assetDataType,
+	start, end time.Time,
+	gaps []intervalType,
+	fetched [][]*Entry) []*Entry {
+	now := r.now().UTC()
+
+	// Entries after settled may still change.
+	settled := now.Add(-r.settleTime)
+	oldest := now.Add(-r.maxAge)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keep(data)
+	for i, gap := range gaps {
+		data.Entries = mergeEntries(data.Entries, fetched[i])
+		if gap.End.After(settled) {
+			gap.End = settled
+		}
+		if gap.Start.Before(gap.End) {
+			data.Covered = addInterval(data.Covered, gap)
+		}
+	}
+	// Answer before trimming so that reads older than maxAge still work
+	startIdx, endIdx := findRange(data.Entries, start, end)
+	result := make([]*Entry, endIdx-startIdx)
+	copy(result, data.Entries[startIdx:endIdx])
+	data.trim(oldest)
+	return result
+}
+
+// assetData returns the data for assetId creating it if needed.
+// Caller must hold the lock.
+func (r *intervalReaderType) assetData(assetId string) *assetDataType {
+	if elem, ok := r.byAsset[assetId]; ok {
+		r.lru.MoveToFront(elem)
+		return elem.Value.(*assetDataType)
+	}
+	data := &assetDataType{AssetId: assetId}
+	r.byAsset[assetId] = r.lru.PushFront(data)
+	r.evict()
+	return data
+}
+
+// evict removes the least recently used assets until there are at most
+// maxAssets. Caller must hold the lock.
+func (r *intervalReaderType) evict() {
+	for r.lru.Len() > r.maxAssets {
+		evicted := r.lru.Remove(r.lru.Back()).(*assetDataType)
+		delete(r.byAsset, evicted.AssetId)
+	}
+}
+
+// keep puts data back in the cache if it got evicted and nothing has
+// replaced it. Caller must hold the lock.
+func (r *intervalReaderType) keep(data *assetDataType) {
+	if elem, ok := r.byAsset[data.AssetId]; ok {
+		if elem.Value.(*assetDataType) == data {
+			r.lru.MoveToFront(elem)
+		}
+		return
+	}
+	r.byAsset[data.AssetId] = r.lru.PushFront(data)
+	r.evict()
+}
+
+// trim discards everything before oldest.
+func (d *assetDataType) trim(oldest time.Time) {
+	idx := sort.Search(
+		len(d.Entries),
+		func(i int) bool { return !d.Entries[i].Time.Before(oldest) })
+	d.Entries = d.Entries[idx:]
+	for len(d.Covered) > 0 && !d.Covered[0].End.After(oldest) {
+		d.Covered = d.Covered[1:]
+	}
+	if len(d.Covered) > 0 && d.Covered[0].Start.Before(oldest) {
+		d.Covered[0].Start = oldest
+	}
+}
+
+// mergeEntries merges newEntries into sorted entries and returns the
+// result. When both have an entry with the same time, the one in newEntries
+// wins.
+func mergeEntries(entries, newEntries []*Entry) []*Entry {
+	if len(newEntries) == 0 {
+		return entries
+	}
+	sortedNew := make([]*Entry, len(newEntries))
+	copy(sortedNew, newEntries)
+	sort.SliceStable(sortedNew, func(i, j int) bool {
+		return sortedNew[i].Time.Before(sortedNew[j].Time)
+	})
+	result := make([]*Entry, 0, len(entries)+len(sortedNew))
+	i, j := 0, 0
+	for i < len(entries) || j < len(sortedNew) {
+		var next *Entry
+		if j == len(sortedNew) ||
+			(i < len(entries) && entries[i].Time.Before(sortedNew[j].Time)) {
+			next = entries[i]
+			i++
+		} else {
+			if i < len(entries) && entries[i].Time.Equal(sortedNew[j].Time) {
+				i++
+			}
+			next = sortedNew[j]
+			j++
+		}
+		// Deduplicate within newEntries too
+		if len(result) > 0 && result[len(result)-1].Time.Equal(next.Time) {
+			result[len(result)-1] = next
+		} else {
+			result = append(result, next)
+		}
+	}
+	return result
+}
+
+// addInterval adds iv to sorted intervals merging as needed and returns
+// the result.
+func addInterval(intervals []intervalType, iv intervalType) []intervalType {
+	result := make([]intervalType, 0, len(intervals)+1)
+	idx := 0
+	for idx < len(intervals) && intervals[idx].End.Before(iv.Start) {
+		result = append(result, intervals[idx])
+		idx++
+	}
+	for idx < len(intervals) && !intervals[idx].Start.After(iv.End) {
+		if intervals[idx].Start.Before(iv.Start) {
+			iv.Start = intervals[idx].Start
+		}
+		if intervals[idx].End.After(iv.End) {
+			iv.End = intervals[idx].End
+		}
+		idx++
+	}
+	result = append(result, iv)
+	return append(result, intervals[idx:]...)
+}
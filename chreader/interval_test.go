@@ -0,0 +1,108 @@
+package chreader_test
+
+import (
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+type timeRangeType struct {
+	Start time.Time
+	End   time.Time
+}
+
+// recordingReaderType records the time ranges it is asked to read.
+type recordingReaderType struct {
+	chreader.Reader
+	Ranges []timeRangeType
+}
+
+func (r *recordingReaderType) Read(
+	assetId string, start, end time.Time) ([]*chreader.Entry, error) {
+	r.Ranges = append(r.Ranges, timeRangeType{Start: start, End: end})
+	return r.Reader.Read(assetId, start, end)
+}
+
+func TestIntervalReader(t *testing.T) {
+
+	Convey("With fake reader", t, func() {
+		recordingReader := &recordingReaderType{Reader: &fakeReaderType{}}
+		now := kNow
+		reader := chreader.NewCustomIntervalReader(
+			recordingReader,
+			chreader.IntervalOptions{MaxAssets: 2},
+			func() time.Time { return now })
+		Convey("Overlapping reads fetch only what is missing", func() {
+			entries, err := reader.Read(
+				"instance", kNow.Add(-6*time.Hour), kNow.Add(-3*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kNow.Add(-6*time.Hour), kNow.Add(-3*time.Hour))
+			entries, err = reader.Read(
+				"instance", kNow.Add(-5*time.Hour), kNow.Add(-2*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kNow.Add(-5*time.Hour), kNow.Add(-2*time.Hour))
+			entries, err = reader.Read(
+				"instance", kNow.Add(-8*time.Hour), kNow.Add(-4*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kNow.Add(-8*time.Hour), kNow.Add(-4*time.Hour))
+			So(recordingReader.Ranges, ShouldResemble, []timeRangeType{
+				{Start: kNow.Add(-6 * time.Hour), End: kNow.Add(-3 * time.Hour)},
+				{Start: kNow.Add(-3 * time.Hour), End: kNow.Add(-2 * time.Hour)},
+				{Start: kNow.Add(-8 * time.Hour), End: kNow.Add(-6 * time.Hour)},
+			})
+		})
+		Convey("Reads spanning several gaps fetch each gap", func() {
+			reader.Read(
+				"instance", kNow.Add(-6*time.Hour), kNow.Add(-5*time.Hour))
+			reader.Read(
+				"instance", kNow.Add(-4*time.Hour), kNow.Add(-3*time.Hour))
+			entries, err := reader.Read(
+				"instance", kNow.Add(-7*time.Hour), kNow.Add(-2*time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kNow.Add(-7*time.Hour), kNow.Add(-2*time.Hour))
+			So(recordingReader.Ranges[2:], ShouldResemble, []timeRangeType{
+				{Start: kNow.Add(-7 * time.Hour), End: kNow.Add(-6 * time.Hour)},
+				{Start: kNow.Add(-5 * time.Hour), End: kNow.Add(-4 * time.Hour)},
+				{Start: kNow.Add(-3 * time.Hour), End: kNow.Add(-2 * time.Hour)},
+			})
+		})
+		Convey("Recent data always fetched again", func() {
+			reader.Read("instance", kNow.Add(-3*time.Hour), kNow)
+			now = kNow.Add(time.Hour)
+			entries, err := reader.Read(
+				"instance", kNow.Add(-2*time.Hour), now)
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kNow.Add(-2*time.Hour), now)
+			// Data within the last hour of the first read not settled
+			So(recordingReader.Ranges[1:], ShouldResemble, []timeRangeType{
+				{Start: kNow.Add(-time.Hour), End: now},
+			})
+		})
+		Convey("Assets are cached separately", func() {
+			reader.Read("a", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			entries, _ := reader.Read(
+				"b", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			So(entries[0].Values, ShouldContainKey, "b")
+			So(recordingReader.Ranges, ShouldHaveLength, 2)
+		})
+		Convey("Least recently used assets evicted", func() {
+			reader.Read("a", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			reader.Read("b", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			reader.Read("a", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			reader.Read("c", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			So(recordingReader.Ranges, ShouldHaveLength, 3)
+			reader.Read("a", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			So(recordingReader.Ranges, ShouldHaveLength, 3)
+			reader.Read("b", kNow.Add(-3*time.Hour), kNow.Add(-2*time.Hour))
+			So(recordingReader.Ranges, ShouldHaveLength, 4)
+		})
+		Convey("Errors propogate and nothing gets cached", func() {
+			_, err := reader.Read("error", kNow.Add(-3*time.Hour), kNow)
+			So(err, ShouldNotBeNil)
+			_, err = reader.Read("error", kNow.Add(-3*time.Hour), kNow)
+			So(err, ShouldNotBeNil)
+			So(recordingReader.Ranges, ShouldHaveLength, 2)
+		})
+	})
+}
@@ -0,0 +1,61 @@
+package chreader
+
+import (
+	"context"
+	"time"
+)
+
+func readIter(
+	ctx context.Context,
+	r Reader,
+	assetId string,
+	start, end time.Time,
+	visit func(entry *Entry) bool) error {
+	if ir, ok := r.(IterReader); ok {
+		return ir.ReadIter(ctx, assetId, start, end, visit)
+	}
+	entries, err := ReadContext(ctx, r, assetId, start, end)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !visit(entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// ReadIter hands over the entries of each page as soon as it is fetched
+// unless they come from r.store.
+func (r *chReaderType) ReadIter(
+	ctx context.Context,
+	assetId string,
+	start, end time.Time,
+	visit func(entry *Entry) bool) error {
+	var lastVisited time.Time
+	var restarted bool
+	emit := func(entries []*Entry) bool {
+		for _, entry := range entries {
+			// Skip what we visited before starting over
+			if restarted && !entry.Time.After(lastVisited) {
+				continue
+			}
+			if !visit(entry) {
+				return false
+			}
+			lastVisited = entry.Time
+		}
+		return true
+	}
+	// If current day changed on the cloud health servers during our query,
+	// start over but don't visit the same entries twice.
+	err := r.restartOnDayChange(func() error {
+		restarted = !lastVisited.IsZero()
+		return r.read(ctx, assetId, start, end, emit)
+	})
+	if err == kErrStopped {
+		return nil
+	}
+	return err
+}
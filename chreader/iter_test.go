@@ -0,0 +1,119 @@
+package chreader_test
+
+import (
+	"context"
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// visitAll returns a visit function that stores entries in result and
+// stops after max entries. max of zero means no limit.
+func visitAll(result *[]*chreader.Entry, max int) func(*chreader.Entry) bool {
+	return func(entry *chreader.Entry) bool {
+		*result = append(*result, entry)
+		return max == 0 || len(*result) < max
+	}
+}
+
+func TestReadIter(t *testing.T) {
+	Convey("With fake cloudhealth", t, func() {
+		fakeCh := &fakeCHType{
+			CurrentTime: kNow,
+			ApiKey:      kApiKey,
+			AssetId:     kAssetId}
+		reader := chreader.NewCustomReader(
+			chreader.Config{
+				ApiKey: kApiKey,
+			},
+			fakeCh,
+			func() time.Time {
+				return kNow
+			},
+		)
+		monthAgo := kMidnight.Add(-31 * 24 * time.Hour)
+		Convey("Visits same entries as Read", func() {
+			var entries []*chreader.Entry
+			err := chreader.ReadIter(
+				context.Background(),
+				reader,
+				kAssetId,
+				monthAgo,
+				kNow,
+				visitAll(&entries, 0))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, kNow)
+		})
+		Convey("Stops fetching when visit returns false", func() {
+			var entries []*chreader.Entry
+			err := chreader.ReadIter(
+				context.Background(),
+				reader,
+				kAssetId,
+				monthAgo,
+				kNow,
+				visitAll(&entries, 150))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, monthAgo.Add(150*time.Hour))
+			So(fakeCh.CallCount, ShouldEqual, 2)
+		})
+		Convey("Readers without ReadIter read everything first", func() {
+			cachingReader := chreader.NewCachingReader(
+				reader, chreader.CachingOptions{})
+			var entries []*chreader.Entry
+			err := chreader.ReadIter(
+				context.Background(),
+				cachingReader,
+				kAssetId,
+				monthAgo,
+				kNow,
+				visitAll(&entries, 150))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, monthAgo.Add(150*time.Hour))
+			So(fakeCh.CallCount, ShouldEqual, 9)
+		})
+		Convey("Reader stack of uhura visits same entries as Read", func() {
+			stack := chreader.NewCoalescingReader(
+				chreader.NewCachingReader(
+					chreader.NewIntervalReader(
+						reader, chreader.IntervalOptions{}),
+					chreader.CachingOptions{}))
+			_, ok := stack.(chreader.IterReader)
+			So(ok, ShouldBeFalse)
+			var entries []*chreader.Entry
+			err := chreader.ReadIter(
+				context.Background(),
+				stack,
+				kAssetId,
+				monthAgo,
+				kNow,
+				visitAll(&entries, 0))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, kNow)
+			entries = nil
+			err = chreader.ReadIter(
+				context.Background(),
+				stack,
+				kAssetId,
+				monthAgo,
+				kNow,
+				visitAll(&entries, 150))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, monthAgo.Add(150*time.Hour))
+		})
+		Convey("Day changing mid read visits nothing twice", func() {
+			fakeCh.FutureTime = kNow.Add(24 * time.Hour)
+			var entries []*chreader.Entry
+			err := chreader.ReadIter(
+				context.Background(),
+				reader,
+				kAssetId,
+				kMidnight.Add(-48*time.Hour),
+				kNow,
+				visitAll(&entries, 0))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kMidnight.Add(-48*time.Hour), kNow)
+		})
+	})
+}
@@ -0,0 +1,99 @@
+package chreader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiterType is a token bucket rate limiter. The bucket holds at most
+// burst tokens and refills at rate tokens per second. Each request takes
+// one token.
+type limiterType struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiterType {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiterType{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (l *limiterType) Wait(ctx context.Context) error {
+	wait := l.reserve(time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	if err := sleepContext(ctx, wait); err != nil {
+		l.unreserve()
+		return err
+	}
+	return nil
+}
+
+// reserve takes a token, possibly going into debt, and returns how long
+// the caller must wait before the token is really theirs.
+func (l *limiterType) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// unreserve gives back a token taken by reserve that the caller did not
+// use.
+func (l *limiterType) unreserve() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+type rateLimitedCHType struct {
+	ch      CH
+	limiter *limiterType
+}
+
+func newRateLimitedCH(
+	ch CH, requestsPerSecond float64, burst int) *rateLimitedCHType {
+	return &rateLimitedCHType{
+		ch:      ch,
+		limiter: newLimiter(requestsPerSecond, burst),
+	}
+}
+
+func (r *rateLimitedCHType) Fetch(url string) (*CHResult, error) {
+	return r.FetchContext(context.Background(), url)
+}
+
+func (r *rateLimitedCHType) FetchContext(ctx context.Context, url string) (
+	*CHResult, error) {
+	startTime := time.Now()
+	err := r.limiter.Wait(ctx)
+	kLimiterWaitTimes.Add(time.Since(startTime))
+	if err != nil {
+		return nil, err
+	}
+	return FetchContext(ctx, r.ch, url)
+}
@@ -0,0 +1,52 @@
+package chreader_test
+
+import (
+	"context"
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// countingCHType counts calls to Fetch and returns empty results.
+type countingCHType struct {
+	CallCount int
+}
+
+func (ch *countingCHType) Fetch(url string) (*chreader.CHResult, error) {
+	ch.CallCount++
+	return &chreader.CHResult{}, nil
+}
+
+func TestRateLimitedCH(t *testing.T) {
+	Convey("With rate limited CH", t, func() {
+		countingCh := &countingCHType{}
+		ch := chreader.NewRateLimitedCH(countingCh, 100.0, 2)
+		Convey("Bursts go through right away", func() {
+			startTime := time.Now()
+			ch.Fetch("url")
+			ch.Fetch("url")
+			So(time.Since(startTime), ShouldBeLessThan, 10*time.Millisecond)
+			So(countingCh.CallCount, ShouldEqual, 2)
+		})
+		Convey("Requests past the burst wait their turn", func() {
+			startTime := time.Now()
+			for i := 0; i < 7; i++ {
+				ch.Fetch("url")
+			}
+			// 2 right away then 5 more at 10ms intervals
+			So(time.Since(startTime), ShouldBeGreaterThanOrEqualTo, 45*time.Millisecond)
+			So(countingCh.CallCount, ShouldEqual, 7)
+		})
+		Convey("Waiting requests give up when context done", func() {
+			slowCh := chreader.NewRateLimitedCH(countingCh, 0.1, 1)
+			slowCh.Fetch("url")
+			ctx, cancel := context.WithTimeout(
+				context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := chreader.FetchContext(ctx, slowCh, "url")
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(countingCh.CallCount, ShouldEqual, 1)
+		})
+	})
+}
@@ -1,13 +1,15 @@
 package chreader
 
 import (
+	"context"
 	"time"
 )
 
 type memoizedReaderKeyType struct {
-	AssetId string
-	Start   time.Time
-	End     time.Time
+	AssetId     string
+	Granularity string
+	Start       time.Time
+	End         time.Time
 }
 
 type memoizedReaderType struct {
@@ -16,18 +18,34 @@ type memoizedReaderType struct {
 }
 
 func (c *memoizedReaderType) Read(assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	return c.ReadContext(context.Background(), assetId, start, end)
+}
+
+func (c *memoizedReaderType) granularity(ctx context.Context) string {
+	return granularityFor(ctx, c.r)
+}
+
+func (c *memoizedReaderType) ReadMetaData(
+	ctx context.Context, assetId string) (*MetaData, error) {
+	return readMetaData(ctx, c.r, assetId)
+}
+
+func (c *memoizedReaderType) ReadContext(
+	ctx context.Context, assetId string, start, end time.Time) (
 	[]*Entry, error) {
 	// Convert to UTC to ensure cache keys match
 	start = start.UTC()
 	end = end.UTC()
 	key := memoizedReaderKeyType{
-		AssetId: assetId,
-		Start:   start,
-		End:     end}
+		AssetId:     assetId,
+		Granularity: c.granularity(ctx),
+		Start:       start,
+		End:         end}
 	result, ok := c.data[key]
 	if !ok {
 		var err error
-		result, err = c.r.Read(assetId, start, end)
+		result, err = ReadContext(ctx, c.r, assetId, start, end)
 		if err != nil {
 			return nil, err
 		}
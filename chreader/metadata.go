@@ -0,0 +1,89 @@
+package chreader
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+var (
+	kGranularityIntervals = map[string]time.Duration{
+		"minute": time.Minute,
+		"hour":   time.Hour,
+		"day":    24 * time.Hour,
+		"week":   7 * 24 * time.Hour,
+	}
+)
+
+func (m *MetaData) interval() time.Duration {
+	return kGranularityIntervals[m.Granularity]
+}
+
+func (m *MetaData) metrics() []string {
+	var result []string
+	for _, key := range m.Keys {
+		if key != "assetId" && key != "timestamp" {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func readMetaData(ctx context.Context, r Reader, assetId string) (
+	*MetaData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if mr, ok := r.(MetaDataReader); ok {
+		return mr.ReadMetaData(ctx, assetId)
+	}
+	return nil, ErrMetaDataNotSupported
+}
+
+func readMetrics(ctx context.Context, r Reader, assetId string) (
+	[]string, error) {
+	metaData, err := readMetaData(ctx, r, assetId)
+	if err == ErrNoMetaData {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := metaData.Metrics()
+	sort.Strings(result)
+	return result, nil
+}
+
+func (r *chReaderType) ReadMetaData(ctx context.Context, assetId string) (
+	*MetaData, error) {
+	if err := checkGranularity(r.granularity(ctx)); err != nil {
+		return nil, err
+	}
+	// Early in the UTC day, cloudhealth may not have anything for today
+	for _, timeRange := range []string{"today", "yesterday"} {
+		chResult, err := FetchContext(
+			ctx, r.ch, r.computeUrlStr(ctx, assetId, timeRange))
+		if err != nil {
+			return nil, err
+		}
+		if metaData := metaDataFor(chResult, assetId); metaData != nil {
+			return metaData, nil
+		}
+	}
+	return nil, ErrNoMetaData
+}
+
+// metaDataFor returns the metadata in result for assetId choosing datasets
+// the same way as entriesFor. metaDataFor returns nil if result has no
+// datasets.
+func metaDataFor(result *CHResult, assetId string) *MetaData {
+	datasets := datasetsFor(result, assetId)
+	if len(datasets) == 0 {
+		return nil
+	}
+	metaData := datasets[0].MetaData
+	for _, dataset := range datasets[1:] {
+		metaData.Keys = unionKeys(metaData.Keys, dataset.MetaData.Keys)
+	}
+	return &metaData
+}
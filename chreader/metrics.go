@@ -0,0 +1,55 @@
+package chreader
+
+import (
+	"github.com/Symantec/tricorder/go/tricorder"
+	"github.com/Symantec/tricorder/go/tricorder/units"
+	"sync/atomic"
+)
+
+var (
+	kWaitTimesMillisBucketer = tricorder.NewGeometricBucketer(1e-3, 1e6)
+	kLimiterWaitTimes        = kWaitTimesMillisBucketer.NewCumulativeDistribution()
+)
+
+var (
+	kDayStoreErrorCount int64
+)
+
+func registerMetrics() error {
+	if err := tricorder.RegisterMetric(
+		"/chreader/rateLimiter/waitTimes",
+		kLimiterWaitTimes,
+		units.Millisecond,
+		"Time requests to CloudHealth spend waiting in the rate limiter"); err != nil {
+		return err
+	}
+	if err := tricorder.RegisterMetric(
+		"/chreader/coalesced/reads",
+		func() int64 { return atomic.LoadInt64(&kCoalescedReadCount) },
+		units.None,
+		"Reads that shared the result of an identical read in progress"); err != nil {
+		return err
+	}
+	if err := tricorder.RegisterMetric(
+		"/chreader/coalesced/fetches",
+		func() int64 { return atomic.LoadInt64(&kCoalescedFetchCount) },
+		units.None,
+		"Fetches that shared the result of an identical fetch in progress"); err != nil {
+		return err
+	}
+	if err := tricorder.RegisterMetric(
+		"/chreader/dayStore/errors",
+		func() int64 { return atomic.LoadInt64(&kDayStoreErrorCount) },
+		units.None,
+		"Failures saving closed days of data"); err != nil {
+		return err
+	}
+	if err := tricorder.RegisterMetric(
+		"/chreader/dayChange/restarts",
+		func() int64 { return atomic.LoadInt64(&kDayChangeRestartCount) },
+		units.None,
+		"Reads started over because the day changed on CloudHealth"); err != nil {
+		return err
+	}
+	return nil
+}
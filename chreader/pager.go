@@ -0,0 +1,142 @@
+package chreader
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+// pageFetchType is a fetch of one page running in the background.
+type pageFetchType struct {
+	Url    string
+	cancel context.CancelFunc
+	done   chan struct{}
+	result *CHResult
+	err    error
+}
+
+func startPageFetch(ctx context.Context, ch CH, url string) *pageFetchType {
+	ctx, cancel := context.WithCancel(ctx)
+	result := &pageFetchType{
+		Url:    url,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(result.done)
+		result.result, result.err = FetchContext(ctx, ch, url)
+	}()
+	return result
+}
+
+// pagerType returns the pages of a CloudHealth result in order. When
+// lookahead is positive, pagerType fetches up to lookahead pages beyond the
+// one being read by guessing their URLs from the page parameter of the
+// next URL. Wrong guesses are thrown away.
+type pagerType struct {
+	ctx       context.Context
+	ch        CH
+	lookahead int
+	nextUrl   string // empty means no more pages
+	fetches   []*pageFetchType
+}
+
+func newPager(
+	ctx context.Context, ch CH, url string, lookahead int) *pagerType {
+	return &pagerType{ctx: ctx, ch: ch, lookahead: lookahead, nextUrl: url}
+}
+
+// Next returns the next page or nil if there are no more pages.
+func (p *pagerType) Next() (*CHResult, error) {
+	if len(p.fetches) == 0 {
+		if p.nextUrl == "" {
+			return nil, nil
+		}
+		if p.lookahead <= 0 {
+			result, err := FetchContext(p.ctx, p.ch, p.nextUrl)
+			if err == nil {
+				p.nextUrl = result.Next
+			}
+			return result, err
+		}
+		p.fetches = append(
+			p.fetches, startPageFetch(p.ctx, p.ch, p.nextUrl))
+	}
+	p.guess()
+	fetch := p.fetches[0]
+	p.fetches = p.fetches[1:]
+	select {
+	case <-fetch.done:
+	case <-p.ctx.Done():
+		fetch.cancel()
+		return nil, p.ctx.Err()
+	}
+	fetch.cancel()
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+	p.nextUrl = fetch.result.Next
+	if len(p.fetches) > 0 && !samePageUrl(p.fetches[0].Url, p.nextUrl) {
+		// Wrong guess
+		p.Close()
+	}
+	return fetch.result, nil
+}
+
+// Close cancels any fetches still running. Callers must call Close if they
+// stop calling Next before it returns nil.
+func (p *pagerType) Close() {
+	for _, fetch := range p.fetches {
+		fetch.cancel()
+	}
+	p.fetches = nil
+}
+
+// guess starts fetches of the pages likely to come after the ones already
+// being fetched.
+func (p *pagerType) guess() {
+	for len(p.fetches) <= p.lookahead {
+		nextUrl, ok := nextPageUrl(p.fetches[len(p.fetches)-1].Url)
+		if !ok {
+			return
+		}
+		p.fetches = append(p.fetches, startPageFetch(p.ctx, p.ch, nextUrl))
+	}
+}
+
+// nextPageUrl returns pageUrl with its page parameter increased by one.
+// nextPageUrl returns false if pageUrl has no page parameter.
+func nextPageUrl(pageUrl string) (string, bool) {
+	u, err := url.Parse(pageUrl)
+	if err != nil {
+		return "", false
+	}
+	values := u.Query()
+	page, err := strconv.Atoi(values.Get("page"))
+	if err != nil {
+		return "", false
+	}
+	values.Set("page", strconv.Itoa(page+1))
+	u.RawQuery = values.Encode()
+	return u.String(), true
+}
+
+// samePageUrl returns true if url1 and url2 are the same ignoring the order
+// of query parameters.
+func samePageUrl(url1, url2 string) bool {
+	if url1 == url2 {
+		return true
+	}
+	u1, err := url.Parse(url1)
+	if err != nil {
+		return false
+	}
+	u2, err := url.Parse(url2)
+	if err != nil {
+		return false
+	}
+	q1, q2 := u1.Query(), u2.Query()
+	u1.RawQuery, u2.RawQuery = "", ""
+	return u1.String() == u2.String() && reflect.DeepEqual(q1, q2)
+}
@@ -0,0 +1,92 @@
+package chreader_test
+
+import (
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowCHType wraps a fakeCHType so that fetches take a while and may run
+// at once. It records how many fetches were running at most.
+type slowCHType struct {
+	Ch *fakeCHType
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	fetchCount int
+}
+
+func (ch *slowCHType) Fetch(url string) (*chreader.CHResult, error) {
+	ch.mu.Lock()
+	ch.running++
+	ch.fetchCount++
+	if ch.running > ch.maxRunning {
+		ch.maxRunning = ch.running
+	}
+	ch.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.running--
+	return ch.Ch.Fetch(url)
+}
+
+func (ch *slowCHType) Counts() (fetchCount, maxRunning int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return ch.fetchCount, ch.maxRunning
+}
+
+func TestPageLookahead(t *testing.T) {
+	Convey("With slow fake cloudhealth", t, func() {
+		slowCh := &slowCHType{
+			Ch: &fakeCHType{
+				CurrentTime: kNow,
+				ApiKey:      kApiKey,
+				AssetId:     kAssetId}}
+		newReader := func(lookahead int) chreader.Reader {
+			return chreader.NewCustomReader(
+				chreader.Config{
+					ApiKey:        kApiKey,
+					PageLookahead: lookahead,
+				},
+				slowCh,
+				func() time.Time {
+					return kNow
+				})
+		}
+		monthAgo := kMidnight.Add(-31 * 24 * time.Hour)
+		Convey("One page at a time by default", func() {
+			entries, err := newReader(0).Read(
+				kAssetId, monthAgo, kMidnight.Add(-time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, kMidnight.Add(-time.Hour))
+			fetchCount, maxRunning := slowCh.Counts()
+			// 744 entries in 8 pages
+			So(fetchCount, ShouldEqual, 8)
+			So(maxRunning, ShouldEqual, 1)
+		})
+		Convey("Pages fetched ahead", func() {
+			entries, err := newReader(3).Read(
+				kAssetId, monthAgo, kMidnight.Add(-time.Hour))
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, monthAgo, kMidnight.Add(-time.Hour))
+			_, maxRunning := slowCh.Counts()
+			So(maxRunning, ShouldBeGreaterThan, 1)
+			So(maxRunning, ShouldBeLessThanOrEqualTo, 4)
+		})
+		Convey("Pages ahead stop at end of read", func() {
+			start := monthAgo.Add(10 * time.Hour)
+			end := monthAgo.Add(150 * time.Hour)
+			entries, err := newReader(3).Read(kAssetId, start, end)
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, start, end)
+			fetchCount, _ := slowCh.Counts()
+			// The 2 pages needed plus at most 3 more
+			So(fetchCount, ShouldBeLessThanOrEqualTo, 5)
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package chreader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// The longest window to ask CloudHealth for in one request when
+	// using explicit time ranges
+	kMaxWindow = 31 * 24 * time.Hour
+)
+
+const (
+	kExplicitTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+func (e *HistoryError) Error() string {
+	return fmt.Sprintf(
+		"chreader: Data before %s out of reach, but read starts at %s",
+		e.Oldest.Format(time.RFC3339),
+		e.Start.Format(time.RFC3339))
+}
+
+func isHistoryOutOfReach(err error) bool {
+	var historyErr *HistoryError
+	return errors.As(err, &historyErr)
+}
+
+// checkHistory returns a *HistoryError if start comes before the oldest
+// time that named time ranges reach unless the config allows partial
+// history. midnight is the start of the current day.
+func (r *chReaderType) checkHistory(start, midnight time.Time) error {
+	if r.config.AllowPartialHistory {
+		return nil
+	}
+	oldest := midnight.Add(-kTimeRanges[len(kTimeRanges)-1].Dur)
+	if start.Before(oldest) {
+		return &HistoryError{Start: start, Oldest: oldest}
+	}
+	return nil
+}
+
+// planWindows splits start to end into consecutive windows no longer than
+// kMaxWindow.
+func planWindows(start, end time.Time) []intervalType {
+	var result []intervalType
+	for start.Before(end) {
+		windowEnd := start.Add(kMaxWindow)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		result = append(result, intervalType{Start: start, End: windowEnd})
+		start = windowEnd
+	}
+	return result
+}
+
+// readExplicitRange works like readRange except that it asks CloudHealth
+// for explicit windows of time. Since these windows don't depend on what
+// day it is, readExplicitRange doesn't need to worry about clock skew.
+func (r *chReaderType) readExplicitRange(
+	ctx context.Context,
+	assetId string,
+	start, end time.Time,
+	emit emitFunc) error {
+	for _, window := range planWindows(start, end) {
+		if err := r.readWindow(ctx, assetId, window, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *chReaderType) readWindow(
+	ctx context.Context,
+	assetId string,
+	window intervalType,
+	emit emitFunc) error {
+	pager := newPager(
+		ctx,
+		r.ch,
+		r.computeExplicitUrlStr(ctx, assetId, window),
+		r.config.PageLookahead)
+	defer pager.Close()
+	for {
+		chResult, err := pager.Next()
+		if chResult == nil || err != nil {
+			return err
+		}
+		batchEntries := entriesFor(chResult, assetId)
+		startIdx, endIdx := findRange(batchEntries, window.Start, window.End)
+		if !emit(batchEntries[startIdx:endIdx]) {
+			return kErrStopped
+		}
+		// If we read an entry on or after the end of the window we are done
+		if endIdx < len(batchEntries) {
+			return nil
+		}
+	}
+}
+
+func (r *chReaderType) computeExplicitUrlStr(
+	ctx context.Context, assetId string, window intervalType) string {
+	return r.computeUrlStrWithParams(
+		ctx,
+		"api_key", r.currentApiKey(),
+		"asset", assetId,
+		"from", window.Start.UTC().Format(kExplicitTimeFormat),
+		"to", window.End.UTC().Format(kExplicitTimeFormat))
+}
@@ -1,53 +1,298 @@
 package chreader
 
 import (
+	"context"
 	"errors"
 	"github.com/Symantec/scotty/lib/httputil"
 	"net/url"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	kCHUrl = mustParseUrl("https://chapi.cloudhealthtech.com/metrics/v1")
+	kCHUrl = mustParseUrl(kDefaultBaseUrl)
+)
+
+const (
+	kDefaultMaxDayChangeRestarts = 3
 )
 
 var (
 	kErrDayChanged = errors.New("chreader: Day changed.")
+	kErrStopped    = errors.New("chreader: Stopped.")
+)
+
+var (
+	kDayChangeRestartCount int64
 )
 
+// emitFunc receives the entries of a read in time order as the read finds
+// them. emitFunc returns false to stop the read.
+type emitFunc func(entries []*Entry) bool
+
 type chReaderType struct {
-	config Config
-	ch     CH
-	now    func() time.Time
+	config  Config
+	baseUrl *url.URL
+	ch      CH
+	now     func() time.Time
+	store   DayStore // nil means no store
+	// Returns the API key; nil means use config.ApiKey
+	apiKey func() string
+}
+
+func newReader(c Config, apiKey func() string) (Reader, error) {
+	baseUrl, err := parseBaseUrl(c.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGranularity(c.Granularity); err != nil {
+		return nil, err
+	}
+	httpCh, err := newCH(&c)
+	if err != nil {
+		return nil, err
+	}
+	var ch CH = httpCh
+	if c.RequestsPerSecond > 0 {
+		ch = newRateLimitedCH(ch, c.RequestsPerSecond, c.Burst)
+	}
+	result := &chReaderType{
+		config:  c,
+		baseUrl: baseUrl,
+		ch:      NewCoalescingCH(newRetryingCH(ch, c.Retry)),
+		now:     time.Now,
+		apiKey:  apiKey,
+	}
+	if c.DiskCacheDir != "" {
+		store, err := sharedDiskDayStore(c.DiskCacheDir, c.DiskCacheMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		result.store = store
+	}
+	return result, nil
+}
+
+// newCheckedReader returns a reader for c using the API key that c names.
+func newCheckedReader(c Config) (Reader, error) {
+	apiKey, err := resolveApiKey(&c)
+	if err != nil {
+		return nil, err
+	}
+	return newReader(c, staticApiKey(apiKey))
+}
+
+func mustNewReader(c Config) Reader {
+	result, err := newCheckedReader(c)
+	if err != nil {
+		panic(err)
+	}
+	return result
 }
 
 func (r *chReaderType) Read(assetId string, start, end time.Time) (
 	[]*Entry, error) {
-	entries, err := r.read(assetId, start, end)
+	return r.ReadContext(context.Background(), assetId, start, end)
+}
 
+func (r *chReaderType) ReadContext(
+	ctx context.Context, assetId string, start, end time.Time) (
+	[]*Entry, error) {
+	var entries []*Entry
+	collect := func(newEntries []*Entry) bool {
+		entries = append(entries, newEntries...)
+		return true
+	}
 	// If current day changed on the cloud health servers during our query,
 	// just start over.
-	for err == kErrDayChanged {
-		entries, err = r.read(assetId, start, end)
+	if err := r.restartOnDayChange(func() error {
+		entries = nil
+		return r.read(ctx, assetId, start, end, collect)
+	}); err != nil {
+		return nil, err
 	}
-	return entries, err
+	return entries, nil
 }
 
-func (r *chReaderType) read(assetId string, start, end time.Time) (
-	[]*Entry, error) {
+// restartOnDayChange calls read and calls it again each time it returns
+// kErrDayChanged up to the configured maximum number of restarts.
+// restartOnDayChange returns ErrTooManyDayChanges when read returns
+// kErrDayChanged after that.
+func (r *chReaderType) restartOnDayChange(read func() error) error {
+	maxRestarts := r.config.MaxDayChangeRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = kDefaultMaxDayChangeRestarts
+	}
+	err := read()
+	for restarts := 0; err == kErrDayChanged; restarts++ {
+		if restarts == maxRestarts {
+			return ErrTooManyDayChanges
+		}
+		atomic.AddInt64(&kDayChangeRestartCount, 1)
+		err = read()
+	}
+	return err
+}
+
+func (r *chReaderType) read(
+	ctx context.Context,
+	assetId string,
+	start, end time.Time,
+	emit emitFunc) error {
+	if err := checkGranularity(r.granularity(ctx)); err != nil {
+		return err
+	}
 	now := r.now().UTC()
 	start = start.UTC()
 	end = end.UTC()
-	midnight := time.Date(
-		now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-	var entries []*Entry
+	midnight := midnightOf(now)
 
 	// Here we keep the Time in the Date content header of the last response
 	// from cloudhealth. We use this to raise kErrDayChanged if the current
 	// day on the cloud health servers changes in the middle of our work.
 	var lastBatchTime time.Time // zero value means no value
 
+	if r.store == nil || !start.Before(midnight) {
+		return r.readRange(
+			ctx, assetId, start, end, midnight, &lastBatchTime, emit)
+	}
+	return r.readWithStore(
+		ctx, assetId, start, end, now, &lastBatchTime, emit)
+}
+
+// readWithStore works like readRange except that it gets entries for days
+// before midnight from r.store when it can and saves the whole days
+// before midnight that it fetches to r.store.
+func (r *chReaderType) readWithStore(
+	ctx context.Context,
+	assetId string,
+	start, end, now time.Time,
+	lastBatchTime *time.Time,
+	emit emitFunc) error {
+	midnight := midnightOf(now)
+	firstDay := midnightOf(start)
+	pastEnd := end
+	if pastEnd.After(midnight) {
+		pastEnd = midnight
+	}
+	// Keyed by the granularity we ask for so that stored days don't get
+	// mixed up when Config.Granularity changes.
+	storeKey := granularityKey(r.granularity(ctx), assetId)
+	if stored, ok := r.loadDays(storeKey, firstDay, pastEnd); ok {
+		startIdx, endIdx := findRange(stored, start, pastEnd)
+		if !emit(stored[startIdx:endIdx]) {
+			return kErrStopped
+		}
+		if !end.After(midnight) {
+			return nil
+		}
+		return r.readRange(
+			ctx, assetId, midnight, end, midnight, lastBatchTime, emit)
+	}
+
+	// Fetch whole days so that we can store them.
+	fetchEnd := end
+	if end.Before(midnight) {
+		fetchEnd = midnightOf(end.Add(-time.Nanosecond)).Add(24 * time.Hour)
+	}
+	var entries []*Entry
+	if err := r.readRange(
+		ctx,
+		assetId,
+		firstDay,
+		fetchEnd,
+		midnight,
+		lastBatchTime,
+		func(newEntries []*Entry) bool {
+			entries = append(entries, newEntries...)
+			return true
+		}); err != nil {
+		return err
+	}
+	r.saveDays(storeKey, entries, firstDay, fetchEnd, now, *lastBatchTime)
+	startIdx, endIdx := findRange(entries, start, end)
+	if !emit(entries[startIdx:endIdx]) {
+		return kErrStopped
+	}
+	return nil
+}
+
+// loadDays returns the stored entries for each day starting with firstDay
+// and ending before end. loadDays returns false if any day is missing.
+func (r *chReaderType) loadDays(
+	assetId string, firstDay, end time.Time) ([]*Entry, bool) {
+	var result []*Entry
+	for day := firstDay; day.Before(end); day = day.Add(24 * time.Hour) {
+		dayEntries, ok := r.store.Get(assetId, day)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, dayEntries...)
+	}
+	return result, true
+}
+
+// saveDays stores the whole days in entries between firstDay and end
+// that ended at least the settle time ago on both our clock and the
+// cloudhealth server's clock. CloudHealth keeps filling in a day for a
+// while after it ends.
+func (r *chReaderType) saveDays(
+	assetId string,
+	entries []*Entry,
+	firstDay, end, now, serverTime time.Time) {
+	settleTime := r.config.DiskCacheSettleTime
+	if settleTime <= 0 {
+		settleTime = kDefaultDaySettleTime
+	}
+	if settled := now.Add(-settleTime); settled.Before(end) {
+		end = settled
+	}
+	if !serverTime.IsZero() {
+		if settled := serverTime.Add(-settleTime); settled.Before(end) {
+			end = settled
+		}
+	}
+	midnight := midnightOf(now)
+	// Days close to the longest time range may be only partly available
+	// if there is clock skew.
+	longestRange := kTimeRanges[len(kTimeRanges)-1].Dur
+	oldestComplete := midnight.Add(-longestRange).Add(24 * time.Hour)
+	for day := firstDay; !day.Add(24 * time.Hour).After(end); day = day.Add(24 * time.Hour) {
+		if day.Before(oldestComplete) {
+			continue
+		}
+		startIdx, endIdx := findRange(entries, day, day.Add(24*time.Hour))
+		// An empty day may be a hiccup at CloudHealth. Don't keep it
+		// forever.
+		if startIdx == endIdx {
+			continue
+		}
+		// Failing to save is not fatal. We just fetch the day again
+		// next time.
+		if err := r.store.Put(
+			assetId, day, entries[startIdx:endIdx]); err != nil {
+			atomic.AddInt64(&kDayStoreErrorCount, 1)
+		}
+	}
+}
+
+// readRange reads entries between start and end passing them to emit.
+// midnight is the start of the current day.
+func (r *chReaderType) readRange(
+	ctx context.Context,
+	assetId string,
+	start, end, midnight time.Time,
+	lastBatchTime *time.Time,
+	emit emitFunc) error {
+	if r.config.ExplicitTimeRanges {
+		return r.readExplicitRange(ctx, assetId, start, end, emit)
+	}
+	if err := r.checkHistory(start, midnight); err != nil {
+		return err
+	}
+
 	// If start is before midnight, use 'yesterday' or 'last_2_days' etc.
 	if start.Before(midnight) {
 
@@ -57,107 +302,110 @@ func (r *chReaderType) read(assetId string, start, end time.Time) (
 		// Get all the entries but if the first entry comes after the start
 		// time we might have clock skew so exit early before fetching all the
 		// entries. That is what "true" means.
-		pastEntries, earlyEnough, lateEnough, err := r.getEntries(
+		earlyEnough, lateEnough, err := r.getEntries(
+			ctx,
 			assetId,
 			currentTimeRange(timeRangeIdx),
 			start,
 			end,
-			&lastBatchTime,
+			lastBatchTime,
+			emit,
 			true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		// If we may have clock skew, use the previous time range just to
 		// be sure we have everything. e.g "last_7_days" becomes "last_14_days"
 		if !earlyEnough {
-			pastEntries, _, lateEnough, err = r.getEntries(
+			_, lateEnough, err = r.getEntries(
+				ctx,
 				assetId,
 				previousTimeRange(timeRangeIdx),
 				start,
 				end,
-				&lastBatchTime,
+				lastBatchTime,
+				emit,
 				false)
 			if err != nil {
-				return nil, err
+				return err
 			}
 		}
-		entries = append(entries, pastEntries...)
 
 		// If for whatever reason, clock skew or not, we don't read any
 		// entries past the end time, supplement with entries from "today"
 		// we do this because our past entries queries only go up to
 		// midnight of the current day
 		if !lateEnough {
-			todaysEntries, _, _, err := r.getEntries(
-				assetId, "today", start, end, &lastBatchTime, false)
+			_, _, err := r.getEntries(
+				ctx,
+				assetId, "today", start, end, lastBatchTime, emit, false)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			entries = append(entries, todaysEntries...)
 		}
 	} else {
 		// start time falls in "today" just get today's entries
-		todaysEntries, earlyEnough, _, err := r.getEntries(
-			assetId, "today", start, end, &lastBatchTime, true)
+		earlyEnough, _, err := r.getEntries(
+			ctx,
+			assetId, "today", start, end, lastBatchTime, emit, true)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		// If we read timestamps on or before start time, we are done
 		if earlyEnough {
-			return todaysEntries, nil
+			return nil
 		}
 
 		// If the earliest entry we read comes after the start time, we may
 		// have clock skew. Supplement with yesterday's entries for good
 		// measure.
-		pastEntries, _, lateEnough, err := r.getEntries(
-			assetId, "yesterday", start, end, &lastBatchTime, false)
+		_, lateEnough, err := r.getEntries(
+			ctx,
+			assetId, "yesterday", start, end, lastBatchTime, emit, false)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		entries = append(entries, pastEntries...)
 
 		// If we don't read entries past the end time, re-get today's data
 		if !lateEnough {
-			todaysEntriesAgain, _, _, err := r.getEntries(
-				assetId, "today", start, end, &lastBatchTime, false)
+			_, _, err := r.getEntries(
+				ctx,
+				assetId, "today", start, end, lastBatchTime, emit, false)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			entries = append(entries, todaysEntriesAgain...)
 		}
 	}
-	return entries, nil
+	return nil
 }
 
 func (r *chReaderType) getEntries(
+	ctx context.Context,
 	assetId,
 	timeRange string, // "last_2_days", "last_7_days", etc.
 	start,
 	end time.Time,
 	lastBatchTime *time.Time,
+	emit emitFunc,
 	exitEarly bool) (
-	result []*Entry, earlyEnough bool, lateEnough bool, err error) {
+	earlyEnough bool, lateEnough bool, err error) {
+	pager := newPager(
+		ctx,
+		r.ch,
+		r.computeUrlStr(ctx, assetId, timeRange),
+		r.config.PageLookahead)
+	defer pager.Close()
 	var chResult *CHResult
-	chResult, err = r.ch.Fetch(r.computeUrlStr(assetId, timeRange))
+	chResult, err = pager.Next()
 	if err != nil {
 		return
 	}
-	batchTime, pderr := time.Parse(
-		"Mon, 2 Jan 2006 15:04:05 MST", chResult.Date)
-	if pderr == nil {
-		batchTime = batchTime.UTC()
-		if !lastBatchTime.IsZero() && batchTime.Day() != lastBatchTime.Day() {
-			err = kErrDayChanged
-			*lastBatchTime = batchTime
-			return
-		}
-		*lastBatchTime = batchTime
+	if err = checkBatchTime(chResult, lastBatchTime); err != nil {
+		return
 	}
 
-	batchEntries := chResult.Entries
-	nextUrl := chResult.Next
+	batchEntries := entriesFor(chResult, assetId)
 
 	// See if we have fetched an entry that is on or before the start time
 	// If so, set early enough flag
@@ -169,7 +417,10 @@ func (r *chReaderType) getEntries(
 	}
 
 	startIdx, endIdx := findRange(batchEntries, start, end)
-	result = append(result, batchEntries[startIdx:endIdx]...)
+	if !emit(batchEntries[startIdx:endIdx]) {
+		err = kErrStopped
+		return
+	}
 
 	// See if we read an entry on or after the end time
 	// If so, we are done.
@@ -179,15 +430,17 @@ func (r *chReaderType) getEntries(
 	}
 
 	// As long as there is a next page
-	for nextUrl != "" {
-		chResult, err = r.ch.Fetch(nextUrl)
-		if err != nil {
+	for {
+		chResult, err = pager.Next()
+		if chResult == nil || err != nil {
 			return
 		}
-		batchEntries = chResult.Entries
-		nextUrl = chResult.Next
+		batchEntries = entriesFor(chResult, assetId)
 		startIdx, endIdx := findRange(batchEntries, start, end)
-		result = append(result, batchEntries[startIdx:endIdx]...)
+		if !emit(batchEntries[startIdx:endIdx]) {
+			err = kErrStopped
+			return
+		}
 
 		// If we read an entry on or after the end time we are done
 		if endIdx < len(batchEntries) {
@@ -195,7 +448,122 @@ func (r *chReaderType) getEntries(
 			return
 		}
 	}
-	return
+}
+
+// checkBatchTime stores the time in the Date header of result in
+// lastBatchTime. checkBatchTime returns kErrDayChanged if the day is
+// different from the one already in lastBatchTime.
+func checkBatchTime(result *CHResult, lastBatchTime *time.Time) error {
+	batchTime, err := time.Parse(
+		"Mon, 2 Jan 2006 15:04:05 MST", result.Date)
+	if err != nil {
+		return nil
+	}
+	batchTime = batchTime.UTC()
+	dayChanged := !lastBatchTime.IsZero() &&
+		batchTime.Day() != lastBatchTime.Day()
+	*lastBatchTime = batchTime
+	if dayChanged {
+		return kErrDayChanged
+	}
+	return nil
+}
+
+// entriesFor returns the entries in result for assetId sorted by time.
+// If result has datasets, entriesFor uses the ones for assetId. If there
+// are none, entriesFor uses the ones for assets under assetId such as the
+// file systems of an instance, and failing that, none of them. A dataset
+// that doesn't say what asset it is for counts as assetId's only if it is
+// the only one. Entries from different assets with the same time get
+// combined into one entry.
+func entriesFor(result *CHResult, assetId string) []*Entry {
+	if len(result.Datasets) == 0 {
+		return result.Entries
+	}
+	matches := datasetsFor(result, assetId)
+	if len(matches) == 1 {
+		return matches[0].Entries
+	}
+	return combineEntries(entriesOfDatasets(matches)...)
+}
+
+// entriesOfDatasets returns the entries of each dataset in datasets.
+func entriesOfDatasets(datasets []*Dataset) [][]*Entry {
+	result := make([][]*Entry, len(datasets))
+	for i, dataset := range datasets {
+		result[i] = dataset.Entries
+	}
+	return result
+}
+
+// datasetsFor returns the datasets in result for assetId as described in
+// entriesFor.
+func datasetsFor(result *CHResult, assetId string) []*Dataset {
+	if len(result.Datasets) == 1 && result.Datasets[0].AssetId == "" {
+		return result.Datasets
+	}
+	return matchingDatasets(result, assetId)
+}
+
+// matchingDatasets returns the datasets in result for assetId or if there
+// are none, the datasets for assets under assetId. Datasets that don't say
+// what asset they are for never match.
+func matchingDatasets(result *CHResult, assetId string) []*Dataset {
+	var matches []*Dataset
+	for _, dataset := range result.Datasets {
+		if dataset.AssetId == assetId {
+			matches = append(matches, dataset)
+		}
+	}
+	if len(matches) == 0 {
+		for _, dataset := range result.Datasets {
+			if isUnderAsset(dataset.AssetId, assetId) {
+				matches = append(matches, dataset)
+			}
+		}
+	}
+	return matches
+}
+
+// isUnderAsset returns true if childId names an asset under assetId such
+// as "arn:aws:ec2:us-east-1:12345678901:instance/i-12345678:fs//dev/xvda"
+// is under "arn:aws:ec2:us-east-1:12345678901:instance/i-12345678" and
+// "arn:aws:ec2:us-east-1:12345678901:instance/i-12345678:fs//".
+// "arn:aws:ec2:us-east-1:12345678901:instance/i-123456789" is not under
+// "arn:aws:ec2:us-east-1:12345678901:instance/i-12345678".
+func isUnderAsset(childId, assetId string) bool {
+	if assetId == "" || len(childId) <= len(assetId) ||
+		!strings.HasPrefix(childId, assetId) {
+		return false
+	}
+	return strings.HasSuffix(assetId, "/") || childId[len(assetId)] == ':'
+}
+
+// combineEntries returns the entries in entryLists sorted by time. Entries
+// with the same time get combined into one entry.
+func combineEntries(entryLists ...[]*Entry) []*Entry {
+	byTime := make(map[int64]*Entry)
+	var result []*Entry
+	for _, entries := range entryLists {
+		for _, entry := range entries {
+			combined, ok := byTime[entry.Time.UnixNano()]
+			if !ok {
+				combined = &Entry{
+					Time:   entry.Time,
+					Values: make(map[string]float64, len(entry.Values)),
+				}
+				byTime[entry.Time.UnixNano()] = combined
+				result = append(result, combined)
+			}
+			for name, value := range entry.Values {
+				combined.Values[name] = value
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result
 }
 
 // findRange returns the start and end index to entries that contain only
@@ -217,12 +585,23 @@ func findRange(entries []*Entry, start, end time.Time) (
 	return
 }
 
-func (r *chReaderType) computeUrlStr(assetId, timeRange string) string {
-	return httputil.AppendParams(
-		kCHUrl,
-		"api_key", r.config.ApiKey,
+func (r *chReaderType) computeUrlStr(
+	ctx context.Context, assetId, timeRange string) string {
+	return r.computeUrlStrWithParams(
+		ctx,
+		"api_key", r.currentApiKey(),
 		"asset", assetId,
-		"time_range", timeRange).String()
+		"time_range", timeRange)
+}
+
+// computeUrlStrWithParams returns the URL with nameValues as parameters
+// along with the granularity to use for ctx, if any.
+func (r *chReaderType) computeUrlStrWithParams(
+	ctx context.Context, nameValues ...string) string {
+	if granularity := r.granularity(ctx); granularity != "" {
+		nameValues = append(nameValues, "granularity", granularity)
+	}
+	return httputil.AppendParams(r.baseUrl, nameValues...).String()
 }
 
 type timeRangeType struct {
@@ -262,6 +641,22 @@ func computeTimeRangeIdx(dur time.Duration) int {
 	return idx
 }
 
+// parseBaseUrl parses the BaseUrl field of a Config.
+func parseBaseUrl(baseUrl string) (*url.URL, error) {
+	if baseUrl == "" {
+		return kCHUrl, nil
+	}
+	return url.Parse(baseUrl)
+}
+
+func mustParseBaseUrl(baseUrl string) *url.URL {
+	result, err := parseBaseUrl(baseUrl)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
 func mustParseUrl(urlStr string) *url.URL {
 	result, err := url.Parse(urlStr)
 	if err != nil {
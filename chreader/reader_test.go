@@ -1,6 +1,7 @@
 package chreader_test
 
 import (
+	"context"
 	"fmt"
 	"github.com/Symantec/scotty/lib/httputil"
 	"github.com/Symantec/uhura/chreader"
@@ -77,7 +78,20 @@ func (ch *fakeCHType) Fetch(rawUrl string) (*chreader.CHResult, error) {
 	midnight := time.Date(inUTC.Year(), inUTC.Month(), inUTC.Day(), 0, 0, 0, 0, time.UTC)
 	var entries []*chreader.Entry
 	var nextPage int
-	if timeRange == "today" {
+	if fromStr := values.Get("from"); fromStr != "" {
+		from, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return nil, err
+		}
+		to, err := time.Parse(time.RFC3339, values.Get("to"))
+		if err != nil {
+			return nil, err
+		}
+		if to.After(ch.CurrentTime) {
+			to = ch.CurrentTime
+		}
+		entries, nextPage = entriesByPage(entriesFromTo(from, to), page)
+	} else if timeRange == "today" {
 		entries, nextPage = entriesByPage(
 			entriesFromTo(midnight, ch.CurrentTime),
 			page)
@@ -234,12 +248,12 @@ func TestReader(t *testing.T) {
 				So(fakeCh.CallCount, ShouldEqual, 9)
 			})
 			Convey("Way in the past", func() {
-				entries, err := reader.Read(
+				_, err := reader.Read(
 					kAssetId,
 					kMidnight.Add(-2000*time.Hour),
 					kMidnight.Add(-1000*time.Hour))
-				So(entries, ShouldBeEmpty)
-				So(err, ShouldBeNil)
+				So(chreader.IsHistoryOutOfReach(err), ShouldBeTrue)
+				So(fakeCh.CallCount, ShouldEqual, 0)
 			})
 		})
 		Convey("With wrong API Key", func() {
@@ -366,6 +380,69 @@ func TestTimeSkew(t *testing.T) {
 	})
 }
 
+func TestHistory(t *testing.T) {
+	Convey("With fake cloudhealth", t, func() {
+		fakeCh := &fakeCHType{
+			CurrentTime: kNow,
+			ApiKey:      kApiKey,
+			AssetId:     kAssetId}
+		newReader := func(config chreader.Config) chreader.Reader {
+			config.ApiKey = kApiKey
+			return chreader.NewCustomReader(
+				config,
+				fakeCh,
+				func() time.Time {
+					return kNow
+				})
+		}
+		sixtyDaysAgo := kMidnight.Add(-60 * 24 * time.Hour)
+		Convey("Named time ranges can't reach 60 days back", func() {
+			_, err := newReader(chreader.Config{}).Read(
+				kAssetId, sixtyDaysAgo, kNow)
+			So(chreader.IsHistoryOutOfReach(err), ShouldBeTrue)
+			historyErr := err.(*chreader.HistoryError)
+			So(historyErr.Start, ShouldResemble, sixtyDaysAgo)
+			So(
+				historyErr.Oldest,
+				ShouldResemble,
+				kMidnight.Add(-31*24*time.Hour))
+		})
+		Convey("Partial history if allowed", func() {
+			entries, err := newReader(
+				chreader.Config{AllowPartialHistory: true}).Read(
+				kAssetId, sixtyDaysAgo, kNow)
+			So(err, ShouldBeNil)
+			So(
+				entries,
+				shouldHaveRange,
+				kMidnight.Add(-31*24*time.Hour),
+				kNow)
+		})
+		Convey("Explicit time ranges read 60 days in windows", func() {
+			entries, err := newReader(
+				chreader.Config{ExplicitTimeRanges: true}).Read(
+				kAssetId, sixtyDaysAgo, kNow)
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, sixtyDaysAgo, kNow)
+			// 31 day window: 744 entries in 8 pages; 29.5 day window:
+			// 708 entries in 8 pages
+			So(fakeCh.CallCount, ShouldEqual, 16)
+		})
+		Convey("Explicit time ranges stop at end of window", func() {
+			entries, err := newReader(
+				chreader.Config{ExplicitTimeRanges: true}).Read(
+				kAssetId, sixtyDaysAgo, sixtyDaysAgo.Add(150*time.Hour))
+			So(err, ShouldBeNil)
+			So(
+				entries,
+				shouldHaveRange,
+				sixtyDaysAgo,
+				sixtyDaysAgo.Add(150*time.Hour))
+			So(fakeCh.CallCount, ShouldEqual, 2)
+		})
+	})
+}
+
 func TestDayChangesMidRequest(t *testing.T) {
 	Convey("cloud health time changes mid request", t, func() {
 		fakeCh := &fakeCHType{
@@ -395,6 +472,156 @@ func TestDayChangesMidRequest(t *testing.T) {
 	})
 }
 
+// flipFlopCHType makes the day on cloudhealth change on every other fetch
+// like a misbehaving proxy might.
+type flipFlopCHType struct {
+	*fakeCHType
+}
+
+func (ch flipFlopCHType) Fetch(rawUrl string) (*chreader.CHResult, error) {
+	result, err := ch.fakeCHType.Fetch(rawUrl)
+	if err == nil && ch.CallCount%2 == 0 {
+		result.Date = ch.CurrentTime.Add(24 * time.Hour).Format(
+			"Mon, 2 Jan 2006 15:04:05 GMT")
+	}
+	return result, err
+}
+
+func TestDayChangesTooOften(t *testing.T) {
+	Convey("cloud health day changes on every other fetch", t, func() {
+		fakeCh := &fakeCHType{
+			CurrentTime: kNow,
+			ApiKey:      kApiKey,
+			AssetId:     kAssetId}
+		reader := chreader.NewCustomReader(
+			chreader.Config{
+				ApiKey:               kApiKey,
+				MaxDayChangeRestarts: 2,
+			},
+			flipFlopCHType{fakeCh},
+			func() time.Time {
+				return kNow
+			},
+		)
+		Convey("Reads needing one fetch succeed", func() {
+			entries, err := reader.Read(kAssetId, kMidnight, kNow)
+			So(err, ShouldBeNil)
+			So(entries, shouldHaveRange, kMidnight, kNow)
+		})
+		Convey("Reads give up after too many restarts", func() {
+			_, err := reader.Read(
+				kAssetId, kMidnight.Add(-48*time.Hour), kNow)
+			So(err, ShouldEqual, chreader.ErrTooManyDayChanges)
+			// 2 fetches for first try and each of 2 restarts
+			So(fakeCh.CallCount, ShouldEqual, 6)
+		})
+		Convey("Iterating gives up after too many restarts", func() {
+			err := chreader.ReadIter(
+				context.Background(),
+				reader,
+				kAssetId,
+				kMidnight.Add(-48*time.Hour),
+				kNow,
+				func(entry *chreader.Entry) bool {
+					return true
+				})
+			So(err, ShouldEqual, chreader.ErrTooManyDayChanges)
+			So(fakeCh.CallCount, ShouldEqual, 6)
+		})
+	})
+}
+
+// cancellingCHType cancels a context after a certain number of fetches.
+type cancellingCHType struct {
+	chreader.CH
+	Cancel      context.CancelFunc
+	CancelAfter int
+	callCount   int
+}
+
+func (ch *cancellingCHType) Fetch(rawUrl string) (*chreader.CHResult, error) {
+	ch.callCount++
+	if ch.callCount == ch.CancelAfter {
+		ch.Cancel()
+	}
+	return ch.CH.Fetch(rawUrl)
+}
+
+func TestReadContext(t *testing.T) {
+	Convey("With fake cloudhealth", t, func() {
+		fakeCh := &fakeCHType{
+			CurrentTime: kNow,
+			ApiKey:      kApiKey,
+			AssetId:     kAssetId}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		Convey("Cancelled context fetches nothing", func() {
+			reader := chreader.NewCustomReader(
+				chreader.Config{
+					ApiKey: kApiKey,
+				},
+				fakeCh,
+				func() time.Time {
+					return kNow
+				},
+			)
+			cancel()
+			_, err := chreader.ReadContext(
+				ctx, reader, kAssetId, kMidnight.Add(-20*time.Hour), kNow)
+			So(err, ShouldEqual, context.Canceled)
+			So(fakeCh.CallCount, ShouldEqual, 0)
+		})
+		Convey("Cancelling context stops pagination", func() {
+			reader := chreader.NewCustomReader(
+				chreader.Config{
+					ApiKey: kApiKey,
+				},
+				&cancellingCHType{
+					CH:          fakeCh,
+					Cancel:      cancel,
+					CancelAfter: 2,
+				},
+				func() time.Time {
+					return kNow
+				},
+			)
+			_, err := chreader.ReadContext(
+				ctx,
+				reader,
+				kAssetId,
+				kMidnight.Add(-400*time.Hour),
+				kMidnight.Add(3*time.Hour))
+			So(err, ShouldEqual, context.Canceled)
+			// Without cancelling, this read takes 9 fetches
+			So(fakeCh.CallCount, ShouldEqual, 2)
+		})
+		Convey("Memoized reader passes context through", func() {
+			reader := chreader.NewMemoizedReader(
+				chreader.NewCustomReader(
+					chreader.Config{
+						ApiKey: kApiKey,
+					},
+					&cancellingCHType{
+						CH:          fakeCh,
+						Cancel:      cancel,
+						CancelAfter: 1,
+					},
+					func() time.Time {
+						return kNow
+					},
+				))
+			_, err := chreader.ReadContext(
+				ctx,
+				reader,
+				kAssetId,
+				kMidnight.Add(-400*time.Hour),
+				kMidnight.Add(3*time.Hour))
+			So(err, ShouldEqual, context.Canceled)
+			So(fakeCh.CallCount, ShouldEqual, 1)
+		})
+	})
+}
+
 func shouldHaveRange(actual interface{}, expected ...interface{}) string {
 	entries := actual.([]*chreader.Entry)
 	start := expected[0].(time.Time)
@@ -406,7 +633,7 @@ func shouldHaveRange(actual interface{}, expected ...interface{}) string {
 		}
 		if entries[idx].Time != ctime {
 			return fmt.Sprintf(
-				"At [%d], expected %v, got %v", ctime, entries[idx].Time)
+				"At [%d], expected %v, got %v", idx, ctime, entries[idx].Time)
 		}
 		idx++
 	}
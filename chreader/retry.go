@@ -0,0 +1,141 @@
+package chreader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	kDefaultMaxAttempts    = 3
+	kDefaultInitialBackoff = 500 * time.Millisecond
+	kDefaultMaxBackoff     = 30 * time.Second
+	kDefaultMaxRetryAfter  = 2 * time.Minute
+)
+
+type retryingCHType struct {
+	ch             CH
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxRetryAfter  time.Duration
+}
+
+func newRetryingCH(ch CH, p RetryPolicy) *retryingCHType {
+	result := &retryingCHType{
+		ch:             ch,
+		maxAttempts:    p.MaxAttempts,
+		initialBackoff: p.InitialBackoff,
+		maxBackoff:     p.MaxBackoff,
+		maxRetryAfter:  p.MaxRetryAfter,
+	}
+	if result.maxAttempts <= 0 {
+		result.maxAttempts = kDefaultMaxAttempts
+	}
+	if result.initialBackoff <= 0 {
+		result.initialBackoff = kDefaultInitialBackoff
+	}
+	if result.maxBackoff <= 0 {
+		result.maxBackoff = kDefaultMaxBackoff
+	}
+	if result.maxBackoff < result.initialBackoff {
+		result.maxBackoff = result.initialBackoff
+	}
+	if result.maxRetryAfter <= 0 {
+		result.maxRetryAfter = kDefaultMaxRetryAfter
+	}
+	return result
+}
+
+func (r *retryingCHType) Fetch(url string) (*CHResult, error) {
+	return r.FetchContext(context.Background(), url)
+}
+
+func (r *retryingCHType) FetchContext(ctx context.Context, url string) (
+	result *CHResult, err error) {
+	backoff := r.initialBackoff
+	for attempt := 1; ; attempt++ {
+		result, err = FetchContext(ctx, r.ch, url)
+		if err == nil || attempt == r.maxAttempts || !isRetryable(err) {
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		wait := jitter(backoff)
+		if retryAfter, ok := retryAfterOf(err); ok && retryAfter > wait {
+			// A bogus Retry-After must not stall the read indefinitely.
+			if retryAfter > r.maxRetryAfter {
+				retryAfter = r.maxRetryAfter
+			}
+			wait = retryAfter
+		}
+		if err = sleepContext(ctx, wait); err != nil {
+			return
+		}
+		backoff *= 2
+		if backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
+
+// isRetryable returns true if err is likely to go away on its own.
+func isRetryable(err error) bool {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Status == http.StatusTooManyRequests ||
+			apiErr.Status >= 500
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// retryAfterOf returns how long the server asked us to wait before trying
+// again.
+func retryAfterOf(err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter == "" {
+		return 0, false
+	}
+	if secs, perr := strconv.Atoi(apiErr.RetryAfter); perr == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, perr := http.ParseTime(apiErr.RetryAfter); perr == nil {
+		return time.Until(when), true
+	}
+	return 0, false
+}
+
+// jitter returns a random duration between d/2 and d so that clients
+// backing off together don't all retry at the same time.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
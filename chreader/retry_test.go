@@ -0,0 +1,129 @@
+package chreader_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/Symantec/uhura/chreader"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const (
+	kOnePage = `{
+	"datasets": [{
+		"metadata": {
+			"assetType": "aws:ec2:instance",
+			"granularity": "hour",
+			"keys": ["assetId", "timestamp", "cpu:used"]
+		},
+		"values": [["assetId", "2017-06-20T00:00:00+00:00", 1.5]]
+	}],
+	"request": {"next": null}
+}`
+)
+
+// flakyServerType serves one page of results after responding with
+// error statuses.
+type flakyServerType struct {
+	// Statuses to respond with before succeeding. 0 means succeed.
+	Statuses []int
+	// Value of Retry-After header sent with error statuses
+	RetryAfter string
+	// number of requests received
+	CallCount int
+}
+
+func (s *flakyServerType) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.CallCount++
+	w.Header().Set("Date", kNow.Format(http.TimeFormat))
+	if s.CallCount <= len(s.Statuses) && s.Statuses[s.CallCount-1] != 0 {
+		if s.RetryAfter != "" {
+			w.Header().Set("Retry-After", s.RetryAfter)
+		}
+		w.WriteHeader(s.Statuses[s.CallCount-1])
+		fmt.Fprintln(w, `{"error": "Something went wrong"}`)
+		return
+	}
+	fmt.Fprintln(w, kOnePage)
+}
+
+func TestRetryingCH(t *testing.T) {
+	Convey("With flaky server", t, func() {
+		flakyServer := &flakyServerType{}
+		server := httptest.NewServer(flakyServer)
+		defer server.Close()
+		ch := chreader.NewRetryingCH(
+			chreader.DefaultCH,
+			chreader.RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Millisecond,
+				MaxBackoff:     2 * time.Millisecond,
+			})
+		Convey("Server errors get retried", func() {
+			flakyServer.Statuses = []int{502, 503}
+			result, err := ch.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(result.Entries, ShouldHaveLength, 1)
+			So(flakyServer.CallCount, ShouldEqual, 3)
+		})
+		Convey("Too many requests gets retried", func() {
+			flakyServer.Statuses = []int{429}
+			_, err := ch.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(flakyServer.CallCount, ShouldEqual, 2)
+		})
+		Convey("Retries stop after max attempts", func() {
+			flakyServer.Statuses = []int{500, 500, 500, 500}
+			_, err := ch.Fetch(server.URL)
+			So(err, ShouldNotBeNil)
+			So(flakyServer.CallCount, ShouldEqual, 3)
+		})
+		Convey("Permanent errors do not get retried", func() {
+			for _, status := range []int{401, 403, 404} {
+				flakyServer.CallCount = 0
+				flakyServer.Statuses = []int{status}
+				_, err := ch.Fetch(server.URL)
+				So(err, ShouldNotBeNil)
+				So(flakyServer.CallCount, ShouldEqual, 1)
+			}
+		})
+		Convey("Retry-After header honored", func() {
+			flakyServer.Statuses = []int{503}
+			flakyServer.RetryAfter = "1"
+			startTime := time.Now()
+			_, err := ch.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(time.Since(startTime), ShouldBeGreaterThanOrEqualTo, time.Second)
+			So(flakyServer.CallCount, ShouldEqual, 2)
+		})
+		Convey("Retry-After header capped", func() {
+			cappedCh := chreader.NewRetryingCH(
+				chreader.DefaultCH,
+				chreader.RetryPolicy{
+					MaxAttempts:    2,
+					InitialBackoff: time.Millisecond,
+					MaxRetryAfter:  10 * time.Millisecond,
+				})
+			flakyServer.Statuses = []int{503}
+			flakyServer.RetryAfter = "3600"
+			startTime := time.Now()
+			_, err := cappedCh.Fetch(server.URL)
+			So(err, ShouldBeNil)
+			So(time.Since(startTime), ShouldBeLessThan, 10*time.Second)
+			So(flakyServer.CallCount, ShouldEqual, 2)
+		})
+		Convey("Cancelling context stops retries", func() {
+			flakyServer.Statuses = []int{503}
+			flakyServer.RetryAfter = "60"
+			ctx, cancel := context.WithTimeout(
+				context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := chreader.FetchContext(ctx, ch, server.URL)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(flakyServer.CallCount, ShouldEqual, 1)
+		})
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/Symantec/scotty/lib/dynconfig"
+	"github.com/Symantec/uhura/chreader"
+	"io"
+	"log"
+	"sync"
+)
+
+// apiKeyFilesType watches API key files. It keeps one watcher per file
+// across reloads of uhura.yaml so that reloading never starts another
+// watcher for a file already watched.
+type apiKeyFilesType struct {
+	logger *log.Logger
+	mu     sync.Mutex
+	byPath map[string]*dynconfig.DynConfig
+}
+
+func newApiKeyFiles(logger *log.Logger) *apiKeyFilesType {
+	return &apiKeyFilesType{
+		logger: logger,
+		byPath: make(map[string]*dynconfig.DynConfig),
+	}
+}
+
+// Get returns a function returning the current key in the file at path.
+func (a *apiKeyFilesType) Get(path string) (func() string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	apiKeyConfig, ok := a.byPath[path]
+	if !ok {
+		var err error
+		apiKeyConfig, err = dynconfig.NewInitialized(
+			path, readApiKey, "apiKey", a.logger)
+		if err != nil {
+			return nil, err
+		}
+		a.byPath[path] = apiKeyConfig
+	}
+	return func() string {
+		return apiKeyConfig.Get().(string)
+	}, nil
+}
+
+func readApiKey(reader io.Reader) (interface{}, error) {
+	key, err := chreader.ReadApiKey(reader)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Symantec/scotty/lib/dynconfig"
+	"github.com/Symantec/scotty/lib/yamlutil"
+	"github.com/Symantec/scotty/tsdb"
+	"github.com/Symantec/scotty/tsdbjson"
+	"github.com/Symantec/uhura/tsdbadapter"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	kDefaultSuggestMax = 25
+	// Assets seen in queries beyond this many are left out of the catalog
+	kMaxSeenAssets = 10000
+	// Metrics queried between refreshes beyond this many are left out of
+	// the catalog until the next refresh finds them.
+	kMaxQueriedMetrics = 10000
+	// How often to refresh the catalog and how long one refresh may take
+	kCatalogRefreshInterval = 10 * time.Minute
+	kCatalogRefreshTimeout  = 5 * time.Minute
+)
+
+var (
+	kErrBadSuggestMax = tsdbjson.NewError(
+		http.StatusBadRequest, errors.New("max must be a positive integer"))
+)
+
+// assetType is an asset in inventory.yaml or seen in a query.
+type assetType struct {
+	Region        string `yaml:"region"`
+	AccountNumber string `yaml:"accountNumber"`
+	InstanceId    string `yaml:"instanceId"`
+	// Empty means the tenant covering AccountNumber
+	Tenant string `yaml:"tenant"`
+}
+
+func (a *assetType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type assetFields assetType
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*assetFields)(a))
+}
+
+func (a *assetType) Asset() *tsdbadapter.Asset {
+	return &tsdbadapter.Asset{
+		Region:        a.Region,
+		AccountNumber: a.AccountNumber,
+		InstanceId:    a.InstanceId,
+	}
+}
+
+// inventoryType is the content of inventory.yaml, the assets to offer
+// in suggestions before anyone queries them.
+type inventoryType struct {
+	Assets []assetType `yaml:"assets"`
+}
+
+func (i *inventoryType) UnmarshalYAML(
+	unmarshal func(interface{}) error) error {
+	type inventoryFields inventoryType
+	return yamlutil.StrictUnmarshalYAML(unmarshal, (*inventoryFields)(i))
+}
+
+// newInventoryConfig watches the inventory at path. newInventoryConfig
+// returns nil if there is no file at path.
+func newInventoryConfig(path string, logger *log.Logger) (
+	*dynconfig.DynConfig, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return dynconfig.NewInitialized(path, newInventory, "inventory", logger)
+}
+
+func newInventory(reader io.Reader) (interface{}, error) {
+	var result inventoryType
+	if err := yamlutil.Read(reader, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// inventoryAssets returns a function returning the current assets in
+// inventory. inventory may be nil.
+func inventoryAssets(inventory *dynconfig.DynConfig) func() []assetType {
+	return func() []assetType {
+		if inventory == nil {
+			return nil
+		}
+		return inventory.Get().(*inventoryType).Assets
+	}
+}
+
+// catalogType knows the metric names and tag values to suggest. It learns
+// assets from queries and from the inventory and learns the metric names
+// of those assets from CloudHealth in the background.
+type catalogType struct {
+	readers   func() *readersType
+	inventory func() []assetType
+	logger    *log.Logger
+
+	mu   sync.Mutex
+	seen map[assetType]bool
+	// openTSDB names by asset as of the last refresh
+	metricsByAsset map[assetType][]string
+	// openTSDB names that queries got values for since the last refresh
+	queried map[string]bool
+}
+
+func newCatalog(
+	readers func() *readersType,
+	inventory func() []assetType,
+	logger *log.Logger) *catalogType {
+	return &catalogType{
+		readers:        readers,
+		inventory:      inventory,
+		logger:         logger,
+		seen:           make(map[assetType]bool),
+		metricsByAsset: make(map[assetType][]string),
+		queried:        make(map[string]bool),
+	}
+}
+
+// Observe adds the asset of a successful query to c. Observe adds the
+// metric only if the query got values for it so that misspelled metrics
+// don't become suggestions.
+func (c *catalogType) Observe(info *infoType, series tsdb.TimeSeries) {
+	asset := assetType{
+		Region:        info.Asset.Region,
+		AccountNumber: info.Asset.AccountNumber,
+		InstanceId:    info.Asset.InstanceId,
+		Tenant:        info.Tenant,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.seen) < kMaxSeenAssets {
+		c.seen[asset] = true
+	}
+	if len(series) > 0 && len(c.queried) < kMaxQueriedMetrics {
+		c.queried[tsdbjson.Escape(info.Name)] = true
+	}
+}
+
+// Loop refreshes c forever.
+func (c *catalogType) Loop() {
+	for {
+		c.Refresh()
+		time.Sleep(kCatalogRefreshInterval)
+	}
+}
+
+// Refresh replaces the metric names in c with the ones CloudHealth has
+// for each known asset. If CloudHealth fails for an asset, the asset
+// keeps the names it had.
+func (c *catalogType) Refresh() {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), kCatalogRefreshTimeout)
+	defer cancel()
+	readers := c.readers()
+	assets := c.Assets()
+	metricsByAsset := make(map[assetType][]string, len(assets))
+	var failures int
+	var firstErr error
+	for _, asset := range assets {
+		names, err := c.metricNames(ctx, readers, &asset)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failures++
+			c.mu.Lock()
+			names = c.metricsByAsset[asset]
+			c.mu.Unlock()
+		}
+		if names != nil {
+			metricsByAsset[asset] = names
+		}
+	}
+	c.mu.Lock()
+	c.metricsByAsset = metricsByAsset
+	c.queried = make(map[string]bool)
+	c.mu.Unlock()
+	if failures > 0 {
+		c.logger.Printf(
+			"Catalog: %d of %d assets failed: %v",
+			failures, len(assets), firstErr)
+	}
+}
+
+func (c *catalogType) metricNames(
+	ctx context.Context, readers *readersType, asset *assetType) (
+	[]string, error) {
+	reader, err := readers.Get(asset.Tenant, asset.AccountNumber)
+	if err != nil {
+		return nil, err
+	}
+	return tsdbadapter.MetricNames(ctx, reader, asset.Asset())
+}
+
+// Assets returns the assets seen in queries and those in the inventory.
+func (c *catalogType) Assets() []assetType {
+	c.mu.Lock()
+	result := make([]assetType, 0, len(c.seen))
+	for asset := range c.seen {
+		result = append(result, asset)
+	}
+	c.mu.Unlock()
+	return append(result, c.inventory()...)
+}
+
+// Suggest answers an openTSDB /api/suggest request. params has the type
+// of suggestion, "metrics", "tagk", or "tagv", in type, the prefix in q,
+// and the maximum number of suggestions in max.
+func (c *catalogType) Suggest(params url.Values) ([]string, error) {
+	max := kDefaultSuggestMax
+	if maxStr := params.Get("max"); maxStr != "" {
+		var err error
+		max, err = strconv.Atoi(maxStr)
+		if err != nil || max <= 0 {
+			return nil, kErrBadSuggestMax
+		}
+	}
+	var candidates map[string]bool
+	switch params.Get("type") {
+	case "metrics":
+		candidates = c.metricSet()
+	case "tagk":
+		candidates = c.tagKeys()
+	case "tagv":
+		candidates = c.tagValues()
+	default:
+		return nil, tsdbjson.NewError(
+			http.StatusBadRequest,
+			fmt.Errorf("Unknown suggest type: %s", params.Get("type")))
+	}
+	prefix := params.Get("q")
+	result := []string{}
+	for candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			result = append(result, candidate)
+		}
+	}
+	sort.Strings(result)
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result, nil
+}
+
+func (c *catalogType) metricSet() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]bool, len(c.queried))
+	for _, names := range c.metricsByAsset {
+		for _, name := range names {
+			result[name] = true
+		}
+	}
+	for name := range c.queried {
+		result[name] = true
+	}
+	return result
+}
+
+func (c *catalogType) tagKeys() map[string]bool {
+	result := map[string]bool{
+		kRegion:        true,
+		kAccountNumber: true,
+		kInstanceId:    true,
+	}
+	if len(c.readers().ByName) > 0 {
+		result[kTenant] = true
+	}
+	return result
+}
+
+func (c *catalogType) tagValues() map[string]bool {
+	result := make(map[string]bool)
+	for _, asset := range c.Assets() {
+		result[asset.Region] = true
+		result[asset.AccountNumber] = true
+		result[asset.InstanceId] = true
+	}
+	for name := range c.readers().ByName {
+		result[name] = true
+	}
+	delete(result, "")
+	return result
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/Symantec/scotty/tsdb"
+	"github.com/Symantec/scotty/tsdbjson"
+	"github.com/Symantec/uhura/chreader"
+	"github.com/Symantec/uhura/chreader/chtest"
+	"github.com/Symantec/uhura/tsdbadapter"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	kNow    = time.Date(2017, 6, 20, 16, 0, 0, 0, time.UTC)
+	kLogger = log.New(ioutil.Discard, "", 0)
+)
+
+// newTestCatalog returns a catalog over readers with the given inventory.
+func newTestCatalog(
+	readers *readersType, inventory ...assetType) *catalogType {
+	return newCatalog(
+		func() *readersType {
+			return readers
+		},
+		func() []assetType {
+			return inventory
+		},
+		kLogger)
+}
+
+// newTestInfo returns the info of a query for name on instanceId.
+func newTestInfo(instanceId, name string) *infoType {
+	return &infoType{
+		Asset: tsdbadapter.Asset{
+			Region:        "us-east-1",
+			AccountNumber: "12345",
+			InstanceId:    instanceId,
+		},
+		Name: name,
+	}
+}
+
+func suggest(catalog *catalogType, params url.Values) []string {
+	result, err := catalog.Suggest(params)
+	So(err, ShouldBeNil)
+	return result
+}
+
+func TestSuggest(t *testing.T) {
+	Convey("With catalog", t, func() {
+		readers := &readersType{
+			ByName:    make(map[string]chreader.Reader),
+			ByAccount: make(map[string]chreader.Reader),
+		}
+		catalog := newTestCatalog(
+			readers,
+			assetType{
+				Region:        "us-west-2",
+				AccountNumber: "67890",
+				InstanceId:    "i-inventory",
+			})
+		someValues := tsdb.TimeSeries{{Ts: 1, Value: 2}}
+		catalog.Observe(newTestInfo("i-1", "cpu:used"), someValues)
+		catalog.Observe(newTestInfo("i-1", "cpu:idle"), someValues)
+		catalog.Observe(newTestInfo("i-2", "memory:used"), someValues)
+		Convey("Metrics with values", func() {
+			So(
+				suggest(catalog, url.Values{"type": {"metrics"}}),
+				ShouldResemble,
+				[]string{
+					tsdbjson.Escape("cpu:idle"),
+					tsdbjson.Escape("cpu:used"),
+					tsdbjson.Escape("memory:used"),
+				})
+		})
+		Convey("Metrics without values left out", func() {
+			catalog.Observe(newTestInfo("i-1", "no:such:metric"), nil)
+			So(
+				suggest(catalog, url.Values{"type": {"metrics"}}),
+				ShouldNotContain,
+				tsdbjson.Escape("no:such:metric"))
+		})
+		Convey("Prefix", func() {
+			So(
+				suggest(catalog, url.Values{
+					"type": {"metrics"},
+					"q":    {tsdbjson.Escape("cpu:")},
+				}),
+				ShouldResemble,
+				[]string{
+					tsdbjson.Escape("cpu:idle"),
+					tsdbjson.Escape("cpu:used"),
+				})
+			So(
+				suggest(catalog, url.Values{"type": {"metrics"}, "q": {"x"}}),
+				ShouldBeEmpty)
+		})
+		Convey("Max", func() {
+			So(
+				suggest(catalog, url.Values{"type": {"metrics"}, "max": {"1"}}),
+				ShouldResemble,
+				[]string{tsdbjson.Escape("cpu:idle")})
+			for _, max := range []string{"0", "-1", "many"} {
+				_, err := catalog.Suggest(
+					url.Values{"type": {"metrics"}, "max": {max}})
+				So(err, ShouldEqual, kErrBadSuggestMax)
+			}
+		})
+		Convey("Tag keys", func() {
+			So(
+				suggest(catalog, url.Values{"type": {"tagk"}}),
+				ShouldResemble,
+				[]string{kAccountNumber, kInstanceId, kRegion})
+			readers.ByName["payer2"] = chreader.NewReader(chreader.Config{})
+			So(
+				suggest(catalog, url.Values{"type": {"tagk"}}),
+				ShouldResemble,
+				[]string{kAccountNumber, kInstanceId, kRegion, kTenant})
+		})
+		Convey("Tag values", func() {
+			So(
+				suggest(catalog, url.Values{"type": {"tagv"}}),
+				ShouldResemble,
+				[]string{
+					"12345",
+					"67890",
+					"i-1",
+					"i-2",
+					"i-inventory",
+					"us-east-1",
+					"us-west-2",
+				})
+			So(
+				suggest(catalog, url.Values{"type": {"tagv"}, "q": {"i-"}}),
+				ShouldResemble,
+				[]string{"i-1", "i-2", "i-inventory"})
+		})
+		Convey("Unknown type", func() {
+			_, err := catalog.Suggest(url.Values{"type": {"tags"}})
+			So(err, ShouldNotBeNil)
+			_, err = catalog.Suggest(url.Values{})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCatalogRefresh(t *testing.T) {
+	Convey("With CloudHealth", t, func() {
+		server := chtest.NewServer(chtest.Options{
+			Assets:  []string{"arn:aws:ec2:us-east-1:12345:instance/i-1"},
+			Metrics: []string{"cpu:used", "memory:free"},
+			Now:     kNow,
+		})
+		defer server.Close()
+		readers := &readersType{
+			Default: chreader.NewCustomReader(
+				chreader.Config{BaseUrl: server.URL},
+				chreader.DefaultCH,
+				func() time.Time {
+					return kNow
+				}),
+		}
+		catalog := newTestCatalog(readers)
+		catalog.Observe(
+			newTestInfo("i-1", "cpu:queried"), tsdb.TimeSeries{{Ts: 1}})
+		Convey("Refresh replaces queried metrics with CloudHealth's", func() {
+			catalog.Refresh()
+			So(
+				suggest(catalog, url.Values{"type": {"metrics"}}),
+				ShouldResemble,
+				[]string{
+					tsdbjson.Escape("cpu:used"),
+					tsdbjson.Escape("memory:free"),
+				})
+		})
+		Convey("Assets CloudHealth doesn't know have no metrics", func() {
+			catalog.Observe(
+				newTestInfo("i-2", "cpu:used"), tsdb.TimeSeries{{Ts: 1}})
+			catalog.Refresh()
+			So(catalog.metricsByAsset, ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// tagFilterType matches the values of one tag.
+type tagFilterType struct {
+	Tagk    string
+	GroupBy bool
+	// The one value matched. Empty if the filter can match other values.
+	Literal string
+	match   func(value string) bool
+}
+
+func (f *tagFilterType) Match(value string) bool {
+	return f.match(value)
+}
+
+// newTagFilter returns the filter for an openTSDB filter of filterType
+// such as "wildcard" on tagk.
+func newTagFilter(filterType, tagk, filter string, groupBy bool) (
+	*tagFilterType, error) {
+	result := &tagFilterType{Tagk: tagk, GroupBy: groupBy}
+	switch filterType {
+	case "literal_or", "iliteral_or", "not_literal_or", "not_iliteral_or":
+		ignoreCase := strings.Contains(filterType, "iliteral")
+		values := strings.Split(filter, "|")
+		result.match = func(value string) bool {
+			for _, v := range values {
+				if v == value || (ignoreCase && strings.EqualFold(v, value)) {
+					return true
+				}
+			}
+			return false
+		}
+		if strings.HasPrefix(filterType, "not_") {
+			matchAny := result.match
+			result.match = func(value string) bool {
+				return !matchAny(value)
+			}
+		} else if filterType == "literal_or" && len(values) == 1 {
+			result.Literal = filter
+		}
+	case "wildcard", "iwildcard":
+		if filterType == "wildcard" && !strings.Contains(filter, "*") {
+			return newTagFilter("literal_or", tagk, filter, groupBy)
+		}
+		expr := "^" + strings.Replace(
+			regexp.QuoteMeta(filter), `\*`, ".*", -1) + "$"
+		if filterType == "iwildcard" {
+			expr = "(?i)" + expr
+		}
+		re := regexp.MustCompile(expr)
+		result.match = re.MatchString
+	case "regexp":
+		re, err := regexp.Compile(filter)
+		if err != nil {
+			return nil, fmt.Errorf("Bad regexp for %s: %v", tagk, err)
+		}
+		result.match = re.MatchString
+	default:
+		return nil, fmt.Errorf("Unsupported filter type: %s", filterType)
+	}
+	return result, nil
+}
+
+// newLegacyTagFilter returns the filter for value in the tags of a query.
+// "*" matches any value; "|" separates several values. Each value of the
+// tag gets its own time series.
+func newLegacyTagFilter(tagk, value string) (*tagFilterType, error) {
+	if value == "*" {
+		return newTagFilter("wildcard", tagk, value, true)
+	}
+	return newTagFilter("literal_or", tagk, value, true)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestTagFilter(t *testing.T) {
+	Convey("Tag filters", t, func() {
+		for _, tc := range []struct {
+			filterType string
+			filter     string
+			literal    string
+			matches    []string
+			misses     []string
+		}{
+			{
+				filterType: "literal_or",
+				filter:     "i-1",
+				literal:    "i-1",
+				matches:    []string{"i-1"},
+				misses:     []string{"I-1", "i-10", ""},
+			},
+			{
+				filterType: "literal_or",
+				filter:     "i-1|i-2",
+				matches:    []string{"i-1", "i-2"},
+				misses:     []string{"i-3", "i-1|i-2"},
+			},
+			{
+				filterType: "iliteral_or",
+				filter:     "i-a|i-b",
+				matches:    []string{"i-a", "I-B"},
+				misses:     []string{"i-c"},
+			},
+			{
+				filterType: "not_literal_or",
+				filter:     "i-1|i-2",
+				matches:    []string{"i-3", "I-1"},
+				misses:     []string{"i-1", "i-2"},
+			},
+			{
+				filterType: "not_iliteral_or",
+				filter:     "i-a",
+				matches:    []string{"i-b"},
+				misses:     []string{"i-a", "I-A"},
+			},
+			{
+				filterType: "wildcard",
+				filter:     "i-*",
+				matches:    []string{"i-", "i-1", "i-abc"},
+				misses:     []string{"I-1", "xi-1"},
+			},
+			{
+				filterType: "wildcard",
+				filter:     "*",
+				matches:    []string{"", "anything"},
+			},
+			{
+				filterType: "wildcard",
+				filter:     "i-1",
+				literal:    "i-1",
+				matches:    []string{"i-1"},
+				misses:     []string{"i-10"},
+			},
+			{
+				filterType: "wildcard",
+				filter:     "us-*.1",
+				matches:    []string{"us-east.1"},
+				misses:     []string{"us-eastx1"},
+			},
+			{
+				filterType: "iwildcard",
+				filter:     "I-*",
+				matches:    []string{"i-1", "I-2"},
+				misses:     []string{"j-1"},
+			},
+			{
+				filterType: "regexp",
+				filter:     "^i-[0-9]+$",
+				matches:    []string{"i-1", "i-23"},
+				misses:     []string{"i-a"},
+			},
+		} {
+			filter, err := newTagFilter(
+				tc.filterType, kInstanceId, tc.filter, false)
+			So(err, ShouldBeNil)
+			So(filter.Tagk, ShouldEqual, kInstanceId)
+			So(filter.GroupBy, ShouldBeFalse)
+			So(filter.Literal, ShouldEqual, tc.literal)
+			for _, value := range tc.matches {
+				So(filter.Match(value), ShouldBeTrue)
+			}
+			for _, value := range tc.misses {
+				So(filter.Match(value), ShouldBeFalse)
+			}
+		}
+	})
+	Convey("Group by", t, func() {
+		filter, err := newTagFilter("wildcard", kRegion, "*", true)
+		So(err, ShouldBeNil)
+		So(filter.GroupBy, ShouldBeTrue)
+	})
+	Convey("Bad filters", t, func() {
+		_, err := newTagFilter("regexp", kInstanceId, "i-(", false)
+		So(err, ShouldNotBeNil)
+		_, err = newTagFilter("prefix", kInstanceId, "i-", false)
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Legacy tag filters", t, func() {
+		for _, tc := range []struct {
+			value   string
+			literal string
+			matches []string
+			misses  []string
+		}{
+			{
+				value:   "*",
+				matches: []string{"i-1", ""},
+			},
+			{
+				value:   "i-1",
+				literal: "i-1",
+				matches: []string{"i-1"},
+				misses:  []string{"i-2", "i-*"},
+			},
+			{
+				value:   "i-1|i-2",
+				matches: []string{"i-1", "i-2"},
+				misses:  []string{"i-3"},
+			},
+			{
+				// Only a lone "*" is a wildcard in tags
+				value:   "i-*",
+				literal: "i-*",
+				matches: []string{"i-*"},
+				misses:  []string{"i-1"},
+			},
+		} {
+			filter, err := newLegacyTagFilter(kInstanceId, tc.value)
+			So(err, ShouldBeNil)
+			So(filter.Tagk, ShouldEqual, kInstanceId)
+			So(filter.GroupBy, ShouldBeTrue)
+			So(filter.Literal, ShouldEqual, tc.literal)
+			for _, value := range tc.matches {
+				So(filter.Match(value), ShouldBeTrue)
+			}
+			for _, value := range tc.misses {
+				So(filter.Match(value), ShouldBeFalse)
+			}
+		}
+	})
+}
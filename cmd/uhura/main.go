@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"github.com/Symantec/scotty/lib/apiutil"
 	"github.com/Symantec/scotty/lib/dynconfig"
 	"github.com/Symantec/scotty/lib/yamlutil"
+	"github.com/Symantec/scotty/tsdb"
 	"github.com/Symantec/scotty/tsdbjson"
 	"github.com/Symantec/tricorder/go/healthserver"
 	"github.com/Symantec/tricorder/go/tricorder"
@@ -21,6 +23,8 @@ import (
 	"net/rpc"
 	"net/url"
 	"path"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -42,6 +46,9 @@ func registerMetrics() error {
 		"Successful query response times"); err != nil {
 		return err
 	}
+	if err := chreader.RegisterMetrics(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -54,61 +61,53 @@ func main() {
 	rpc.HandleHTTP()
 	circularBuffer := logbuf.New()
 	logger := log.New(circularBuffer, "", log.LstdFlags)
+	// Shared across reloads so that each key file has one watcher
+	apiKeyFiles := newApiKeyFiles(logger)
 	readerConfig, err := dynconfig.NewInitialized(
 		path.Join(*fConfigDir, "uhura.yaml"),
-		newReader,
-		"reader",
+		func(reader io.Reader) (interface{}, error) {
+			return newReaders(reader, apiKeyFiles)
+		},
+		"readers",
 		logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+	inventory, err := newInventoryConfig(
+		path.Join(*fConfigDir, "inventory.yaml"), logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	catalog := newCatalog(
+		func() *readersType {
+			return readerConfig.Get().(*readersType)
+		},
+		inventoryAssets(inventory),
+		logger)
+	go catalog.Loop()
 	http.Handle("/",
 		&splash.Handler{
 			Log: circularBuffer,
 		})
 	http.Handle(
 		"/api/query",
-		newTsdbHandler(
-			func(r *tsdbjson.QueryRequest) ([]tsdbjson.TimeSeries, error) {
-				beginTime := time.Now()
-				start := r.StartInMillis
-				end := r.EndInMillis
-				if end == 0 {
-					end = time.Now().Unix() * 1000
-				}
-				reader := chreader.NewMemoizedReader(
-					readerConfig.Get().(chreader.Reader))
-				var result []tsdbjson.TimeSeries
-				for _, query := range r.Queries {
-					info, err := extractInfo(query)
-					if err != nil {
-						return nil, err
-					}
-					timeSeries, err := fetchTimeSeries(
-						reader,
-						&info.Asset,
-						info.Name,
-						start,
-						end)
-					if err != nil {
-						return nil, err
-					}
-					result = append(result, timeSeries)
-				}
-				kTriQueryTimeDist.Add(time.Since(beginTime))
-				return result, nil
-			}))
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Build the handler per request so that a client going away
+			// cancels any outstanding CloudHealth requests.
+			newQueryHandler(
+				r.Context(), readerConfig, catalog).ServeHTTP(w, r)
+		}))
 	http.Handle(
 		"/api/suggest",
 		newTsdbHandler(
 			func(req url.Values) ([]string, error) {
-				return []string{}, nil
+				return catalog.Suggest(req)
 			}))
 	http.Handle(
 		"/api/aggregators",
 		newTsdbHandler(
 			func(req url.Values) ([]string, error) {
-				return []string{"avg"}, nil
+				return tsdbadapter.Aggregators(), nil
 			}))
 	http.Handle(
 		"/api/version",
@@ -168,81 +167,470 @@ func newTsdbHandler(handler interface{}) http.Handler {
 	return apiutil.NewHandler(handler, kOptions)
 }
 
+func newQueryHandler(
+	ctx context.Context,
+	readerConfig *dynconfig.DynConfig,
+	catalog *catalogType) http.Handler {
+	return newTsdbHandler(
+		func(r *tsdbjson.QueryRequest) ([]tsdbjson.TimeSeries, error) {
+			beginTime := time.Now()
+			start := r.StartInMillis
+			end := r.EndInMillis
+			if end == 0 {
+				end = time.Now().Unix() * 1000
+			}
+			readers := readerConfig.Get().(*readersType)
+			// Queries matching no assets still return a list
+			result := []tsdbjson.TimeSeries{}
+			for _, query := range r.Queries {
+				queryInfo, err := extractInfo(query)
+				if err != nil {
+					return nil, tsdbjson.NewError(http.StatusBadRequest, err)
+				}
+				reducer, err := tsdbadapter.NewReducer(
+					query.Aggregator, query.Downsample)
+				if err != nil {
+					return nil, tsdbjson.NewError(http.StatusBadRequest, err)
+				}
+				// Don't fetch finer values than the query needs
+				queryCtx, err := tsdbadapter.WithDownsample(
+					ctx, query.Downsample)
+				if err != nil {
+					return nil, tsdbjson.NewError(http.StatusBadRequest, err)
+				}
+				infos, err := resolveAssets(queryInfo, catalog, readers)
+				if err != nil {
+					// Unknown tenant or no tenant for the account
+					return nil, tsdbjson.NewError(http.StatusBadRequest, err)
+				}
+				fetched, err := fetchAll(queryCtx, infos, start, end)
+				if err != nil {
+					return nil, toTsdbError(err)
+				}
+				for info, series := range fetched {
+					catalog.Observe(info, series)
+				}
+				result = append(
+					result,
+					groupTimeSeries(
+						queryInfo, infos, fetched, reducer, start, end)...)
+			}
+			kTriQueryTimeDist.Add(time.Since(beginTime))
+			return result, nil
+		})
+}
+
+// queryInfoType is what one openTSDB query asks for.
+type queryInfoType struct {
+	Name   string
+	Tenant string // empty if the query has no tenant tag
+	// Filters on region, accountNumber, and instanceId
+	Filters []*tagFilterType
+}
+
+// infoType is one asset that a query reads.
 type infoType struct {
-	Asset tsdbadapter.Asset
-	Name  string
+	Asset  tsdbadapter.Asset
+	Name   string
+	Tenant string // empty if the query has no tenant tag
+	Reader chreader.Reader
 }
 
 var (
-	kTagsRequired = errors.New("region, accountNumber, and instanceId tags required")
+	kTagsRequired  = errors.New("region, accountNumber, or instanceId tag required")
+	kTenantLiteral = errors.New("tenant tag must have a single value")
 )
 
 var (
 	kRegion        = "region"
 	kAccountNumber = "accountNumber"
 	kInstanceId    = "instanceId"
+	kTenant        = "tenant"
+)
+
+var (
+	// The tags of an asset in the order they appear in group keys
+	kAssetTags = []string{kRegion, kAccountNumber, kInstanceId}
 )
 
-func extractInfo(query *tsdbjson.Query) (*infoType, error) {
-	var result infoType
+// extractInfo extracts the metric name and tag filters from query.
+func extractInfo(query *tsdbjson.Query) (*queryInfoType, error) {
+	var result queryInfoType
 	result.Name = tsdbjson.Unescape(query.Metric)
-	for _, filter := range query.Filters {
+	add := func(filter *tagFilterType, err error) error {
+		if err != nil {
+			return err
+		}
 		switch filter.Tagk {
-		case kRegion:
-			result.Asset.Region = filter.Filter
-		case kAccountNumber:
-			result.Asset.AccountNumber = filter.Filter
-		case kInstanceId:
-			result.Asset.InstanceId = filter.Filter
+		case kRegion, kAccountNumber, kInstanceId:
+			result.Filters = append(result.Filters, filter)
+		case kTenant:
+			if filter.Literal == "" {
+				return kTenantLiteral
+			}
+			result.Tenant = filter.Literal
+		}
+		return nil
+	}
+	for _, filter := range query.Filters {
+		if err := add(newTagFilter(
+			filter.Type,
+			filter.Tagk,
+			filter.Filter,
+			filter.GroupBy)); err != nil {
+			return nil, err
 		}
 	}
 	for k, v := range query.Tags {
-		switch k {
-		case kRegion:
-			result.Asset.Region = v
-		case kAccountNumber:
-			result.Asset.AccountNumber = v
-		case kInstanceId:
-			result.Asset.InstanceId = v
+		if err := add(newLegacyTagFilter(k, v)); err != nil {
+			return nil, err
 		}
 	}
-	if result.Asset.Region == "" || result.Asset.AccountNumber == "" || result.Asset.InstanceId == "" {
+	if len(result.Filters) == 0 {
 		return nil, kTagsRequired
 	}
 	return &result, nil
 }
 
-func fetchTimeSeries(
-	reader chreader.Reader,
-	asset *tsdbadapter.Asset,
-	name string,
+// resolveAssets returns the assets that queryInfo matches among those
+// catalog knows along with their readers. If queryInfo names exactly one
+// region, account, and instance, resolveAssets returns that asset even if
+// catalog doesn't know it.
+func resolveAssets(
+	queryInfo *queryInfoType,
+	catalog *catalogType,
+	readers *readersType) ([]*infoType, error) {
+	if exact, ok := exactAsset(queryInfo); ok {
+		reader, err := readers.Get(queryInfo.Tenant, exact.AccountNumber)
+		if err != nil {
+			return nil, err
+		}
+		return []*infoType{
+			{
+				Asset:  *exact,
+				Name:   queryInfo.Name,
+				Tenant: queryInfo.Tenant,
+				Reader: reader,
+			},
+		}, nil
+	}
+	var result []*infoType
+	seen := make(map[tsdbadapter.Asset]bool)
+	for _, asset := range catalog.Assets() {
+		if seen[*asset.Asset()] || !matchesAll(queryInfo.Filters, &asset) {
+			continue
+		}
+		seen[*asset.Asset()] = true
+		tenant := queryInfo.Tenant
+		if tenant == "" {
+			tenant = asset.Tenant
+		}
+		reader, err := readers.Get(tenant, asset.AccountNumber)
+		if err != nil {
+			// No tenant covers the asset
+			continue
+		}
+		result = append(result, &infoType{
+			Asset:  *asset.Asset(),
+			Name:   queryInfo.Name,
+			Tenant: queryInfo.Tenant,
+			Reader: reader,
+		})
+	}
+	return result, nil
+}
+
+// exactAsset returns the asset queryInfo names if its filters name one
+// value for each of region, accountNumber, and instanceId.
+func exactAsset(queryInfo *queryInfoType) (*tsdbadapter.Asset, bool) {
+	literals := make(map[string]string)
+	for _, filter := range queryInfo.Filters {
+		if filter.Literal == "" {
+			return nil, false
+		}
+		literal, ok := literals[filter.Tagk]
+		if ok && literal != filter.Literal {
+			return nil, false
+		}
+		literals[filter.Tagk] = filter.Literal
+	}
+	if len(literals) != len(kAssetTags) {
+		return nil, false
+	}
+	return &tsdbadapter.Asset{
+		Region:        literals[kRegion],
+		AccountNumber: literals[kAccountNumber],
+		InstanceId:    literals[kInstanceId],
+	}, true
+}
+
+func matchesAll(filters []*tagFilterType, asset *assetType) bool {
+	for _, filter := range filters {
+		if !filter.Match(assetTag(asset.Asset(), filter.Tagk)) {
+			return false
+		}
+	}
+	return true
+}
+
+// assetTag returns the value of the tagk tag of asset.
+func assetTag(asset *tsdbadapter.Asset, tagk string) string {
+	switch tagk {
+	case kRegion:
+		return asset.Region
+	case kAccountNumber:
+		return asset.AccountNumber
+	case kInstanceId:
+		return asset.InstanceId
+	}
+	return ""
+}
+
+// fetchAll fetches the time series of each of infos. fetchAll leaves out
+// assets CloudHealth doesn't know unless infos has just one asset.
+func fetchAll(
+	ctx context.Context,
+	infos []*infoType,
 	start,
-	end int64) (tsdbjson.TimeSeries, error) {
-	dps, err := tsdbadapter.Fetch(
-		reader,
-		asset,
-		name,
-		start,
-		end)
-	if err != nil {
-		return tsdbjson.TimeSeries{}, err
-	}
-	return tsdbjson.TimeSeries{
-		Metric: name,
-		Tags: map[string]string{
-			kRegion:        asset.Region,
-			kAccountNumber: asset.AccountNumber,
-			kInstanceId:    asset.InstanceId,
-		},
-		AggregateTags: []string{},
-		Dps:           dps,
-	}, nil
+	end int64) (map[*infoType]tsdb.TimeSeries, error) {
+	result := make(map[*infoType]tsdb.TimeSeries)
+	if len(infos) == 1 {
+		info := infos[0]
+		dps, err := tsdbadapter.FetchContext(
+			ctx, info.Reader, &info.Asset, info.Name, start, end)
+		if err != nil {
+			return nil, err
+		}
+		result[info] = dps
+		return result, nil
+	}
+	byReader := make(map[chreader.Reader][]*infoType)
+	for _, info := range infos {
+		byReader[info.Reader] = append(byReader[info.Reader], info)
+	}
+	for reader, readerInfos := range byReader {
+		assets := make([]*tsdbadapter.Asset, len(readerInfos))
+		for i := range readerInfos {
+			assets[i] = &readerInfos[i].Asset
+		}
+		series, errs := tsdbadapter.FetchMany(
+			ctx, reader, assets, readerInfos[0].Name, start, end)
+		for i, info := range readerInfos {
+			if chreader.IsNotFound(errs[i]) {
+				continue
+			}
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+			result[info] = series[i]
+		}
+	}
+	return result, nil
 }
 
-func newReader(reader io.Reader) (interface{}, error) {
+// groupTimeSeries makes one openTSDB time series for each group of the
+// fetched assets in infos. Assets are in the same group when they have
+// the same values for the tags that queryInfo groups by.
+func groupTimeSeries(
+	queryInfo *queryInfoType,
+	infos []*infoType,
+	fetched map[*infoType]tsdb.TimeSeries,
+	reducer *tsdbadapter.Reducer,
+	start,
+	end int64) []tsdbjson.TimeSeries {
+	groupBy := make(map[string]bool)
+	for _, filter := range queryInfo.Filters {
+		if filter.GroupBy {
+			groupBy[filter.Tagk] = true
+		}
+	}
+	var keys []string
+	groups := make(map[string][]*infoType)
+	for _, info := range infos {
+		if _, ok := fetched[info]; !ok {
+			continue
+		}
+		var keyParts []string
+		for _, tagk := range kAssetTags {
+			if groupBy[tagk] {
+				keyParts = append(keyParts, assetTag(&info.Asset, tagk))
+			}
+		}
+		key := strings.Join(keyParts, "\x00")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], info)
+	}
+	sort.Strings(keys)
+	result := make([]tsdbjson.TimeSeries, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		timeSeries := tsdbjson.TimeSeries{
+			Metric:        queryInfo.Name,
+			Tags:          make(map[string]string),
+			AggregateTags: []string{},
+		}
+		// Tags with the same value for every asset in the group are
+		// tags; the rest are aggregate tags.
+		for _, tagk := range kAssetTags {
+			value := assetTag(&group[0].Asset, tagk)
+			same := true
+			for _, info := range group[1:] {
+				if assetTag(&info.Asset, tagk) != value {
+					same = false
+					break
+				}
+			}
+			if same {
+				timeSeries.Tags[tagk] = value
+			} else {
+				timeSeries.AggregateTags = append(
+					timeSeries.AggregateTags, tagk)
+			}
+		}
+		if queryInfo.Tenant != "" {
+			timeSeries.Tags[kTenant] = queryInfo.Tenant
+		}
+		series := make([]tsdb.TimeSeries, len(group))
+		for i, info := range group {
+			series[i] = fetched[info]
+		}
+		timeSeries.Dps = reducer.Reduce(series, start, end)
+		result = append(result, timeSeries)
+	}
+	return result
+}
+
+// toTsdbError converts an error from CloudHealth into an error with the
+// appropriate openTSDB status code.
+func toTsdbError(err error) error {
+	switch {
+	case chreader.IsNotFound(err):
+		return tsdbjson.NewError(http.StatusNotFound, err)
+	case chreader.IsRateLimited(err):
+		return tsdbjson.NewError(http.StatusTooManyRequests, err)
+	case chreader.IsUnauthorized(err):
+		// Our API key is bad, not the caller's credentials
+		return tsdbjson.NewError(http.StatusBadGateway, err)
+	case err == chreader.ErrTooManyDayChanges:
+		return tsdbjson.NewError(http.StatusBadGateway, err)
+	case chreader.IsHistoryOutOfReach(err):
+		return tsdbjson.NewError(http.StatusBadRequest, err)
+	}
+	var apiErr *chreader.APIError
+	if errors.As(err, &apiErr) {
+		return tsdbjson.NewError(http.StatusBadGateway, err)
+	}
+	return err
+}
+
+// readersType holds the readers of each CloudHealth tenant.
+type readersType struct {
+	// The reader for accounts no tenant covers. nil if uhura.yaml has
+	// tenants but no API key of its own.
+	Default   chreader.Reader
+	ByName    map[string]chreader.Reader
+	ByAccount map[string]chreader.Reader
+}
+
+// Get returns the reader of the named tenant. If tenant is empty, Get
+// returns the reader of the tenant covering accountNumber.
+func (r *readersType) Get(tenant, accountNumber string) (
+	chreader.Reader, error) {
+	if tenant != "" {
+		if reader, ok := r.ByName[tenant]; ok {
+			return reader, nil
+		}
+		return nil, fmt.Errorf("Unknown tenant: %s", tenant)
+	}
+	if reader, ok := r.ByAccount[accountNumber]; ok {
+		return reader, nil
+	}
+	if r.Default != nil {
+		return r.Default, nil
+	}
+	return nil, fmt.Errorf("No tenant covers account %s", accountNumber)
+}
+
+// newReaders returns the readers that the uhura.yaml in reader configures.
+func newReaders(reader io.Reader, apiKeyFiles *apiKeyFilesType) (
+	*readersType, error) {
 	var config chreader.Config
 	if err := yamlutil.Read(reader, &config); err != nil {
 		return nil, err
 	}
-	return chreader.NewReader(config), nil
+	return newReadersFromConfig(&config, apiKeyFiles)
+}
+
+func newReadersFromConfig(
+	config *chreader.Config, apiKeyFiles *apiKeyFilesType) (
+	*readersType, error) {
+	result := &readersType{
+		ByName:    make(map[string]chreader.Reader),
+		ByAccount: make(map[string]chreader.Reader),
+	}
+	if hasApiKey(config) || len(config.Tenants) == 0 {
+		var err error
+		result.Default, err = newReader(*config, apiKeyFiles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range config.Tenants {
+		tenant := &config.Tenants[i]
+		if tenant.Name == "" {
+			return nil, errors.New("Tenants need a name")
+		}
+		if _, ok := result.ByName[tenant.Name]; ok {
+			return nil, fmt.Errorf("Duplicate tenant: %s", tenant.Name)
+		}
+		reader, err := newReader(config.TenantConfig(tenant), apiKeyFiles)
+		if err != nil {
+			return nil, fmt.Errorf("Tenant %s: %v", tenant.Name, err)
+		}
+		result.ByName[tenant.Name] = reader
+		for _, accountNumber := range tenant.AccountNumbers {
+			if _, ok := result.ByAccount[accountNumber]; ok {
+				return nil, fmt.Errorf(
+					"Account %s in more than one tenant", accountNumber)
+			}
+			result.ByAccount[accountNumber] = reader
+		}
+	}
+	return result, nil
+}
+
+func hasApiKey(config *chreader.Config) bool {
+	return config.ApiKey != "" ||
+		config.ApiKeyEnv != "" ||
+		config.ApiKeyFile != "" ||
+		len(config.ApiKeyCommand) > 0
+}
+
+// newReader returns the reader for config with its caches. The caches
+// need whole reads, so the result doesn't implement chreader.IterReader:
+// tsdbadapter.Fetch gets every entry of a read in memory at once. Only a
+// bare chreader reader streams entries page by page.
+func newReader(config chreader.Config, apiKeyFiles *apiKeyFilesType) (
+	chreader.Reader, error) {
+	var result chreader.Reader
+	var err error
+	if config.ApiKeyFile != "" {
+		// Pick up a new key as soon as the key file changes.
+		var apiKey func() string
+		apiKey, err = apiKeyFiles.Get(config.ApiKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		result, err = chreader.NewReaderWithApiKey(config, apiKey)
+	} else {
+		result, err = chreader.NewCheckedReader(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result = chreader.NewIntervalReader(result, config.Intervals)
+	result = chreader.NewCachingReader(result, config.Cache)
+	return chreader.NewCoalescingReader(result), nil
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"github.com/Symantec/scotty/tsdb"
+	"github.com/Symantec/scotty/tsdbjson"
+	"github.com/Symantec/uhura/chreader"
+	"github.com/Symantec/uhura/tsdbadapter"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// newTestQueryInfo returns the query info for name with the given tags.
+func newTestQueryInfo(
+	name, tenant string, tags map[string]string) *queryInfoType {
+	result := &queryInfoType{Name: name, Tenant: tenant}
+	for _, tagk := range kAssetTags {
+		if value, ok := tags[tagk]; ok {
+			filter, err := newLegacyTagFilter(tagk, value)
+			So(err, ShouldBeNil)
+			result.Filters = append(result.Filters, filter)
+		}
+	}
+	return result
+}
+
+// assetsOf returns the instance ids and tenants of infos.
+func assetsOf(infos []*infoType) []string {
+	var result []string
+	for _, info := range infos {
+		result = append(result, info.Asset.InstanceId+"/"+info.Tenant)
+	}
+	return result
+}
+
+func TestExtractInfo(t *testing.T) {
+	Convey("Extract info", t, func() {
+		queryInfo, err := extractInfo(&tsdbjson.Query{
+			Metric: tsdbjson.Escape("cpu:used"),
+			Tags:   map[string]string{kTenant: "payer2"},
+			Filters: []*tsdbjson.Filter{
+				{Type: "wildcard", Tagk: kRegion, Filter: "us-*"},
+			},
+		})
+		So(err, ShouldBeNil)
+		So(queryInfo.Name, ShouldEqual, "cpu:used")
+		So(queryInfo.Tenant, ShouldEqual, "payer2")
+		So(queryInfo.Filters, ShouldHaveLength, 1)
+		So(queryInfo.Filters[0].Tagk, ShouldEqual, kRegion)
+	})
+	Convey("Bad queries", t, func() {
+		for _, query := range []*tsdbjson.Query{
+			{Metric: "cpu"},
+			{Metric: "cpu", Tags: map[string]string{kTenant: "payer2"}},
+			{
+				Metric: "cpu",
+				Tags:   map[string]string{kRegion: "*", kTenant: "*"},
+			},
+			{
+				Metric: "cpu",
+				Filters: []*tsdbjson.Filter{
+					{Type: "regexp", Tagk: kRegion, Filter: "us-("},
+				},
+			},
+		} {
+			_, err := extractInfo(query)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestResolveAssets(t *testing.T) {
+	Convey("With tenants", t, func() {
+		defaultReader := chreader.NewReader(chreader.Config{})
+		payer2Reader := chreader.NewReader(chreader.Config{})
+		readers := &readersType{
+			Default:   defaultReader,
+			ByName:    map[string]chreader.Reader{"payer2": payer2Reader},
+			ByAccount: map[string]chreader.Reader{"67890": payer2Reader},
+		}
+		catalog := newTestCatalog(
+			readers,
+			assetType{
+				Region:        "us-east-1",
+				AccountNumber: "12345",
+				InstanceId:    "i-1",
+			},
+			assetType{
+				Region:        "us-east-1",
+				AccountNumber: "12345",
+				InstanceId:    "i-2",
+			},
+			assetType{
+				Region:        "us-west-2",
+				AccountNumber: "67890",
+				InstanceId:    "i-3",
+				Tenant:        "payer2",
+			})
+		Convey("Exact assets need not be in the catalog", func() {
+			infos, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "", map[string]string{
+					kRegion:        "eu-west-1",
+					kAccountNumber: "67890",
+					kInstanceId:    "i-unknown",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldBeNil)
+			So(infos, ShouldHaveLength, 1)
+			So(infos[0].Asset, ShouldResemble, tsdbadapter.Asset{
+				Region:        "eu-west-1",
+				AccountNumber: "67890",
+				InstanceId:    "i-unknown",
+			})
+			So(infos[0].Name, ShouldEqual, "cpu:used")
+			So(infos[0].Reader, ShouldEqual, payer2Reader)
+		})
+		Convey("Exact asset of named tenant", func() {
+			infos, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "payer2", map[string]string{
+					kRegion:        "us-east-1",
+					kAccountNumber: "12345",
+					kInstanceId:    "i-1",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldBeNil)
+			So(assetsOf(infos), ShouldResemble, []string{"i-1/payer2"})
+			So(infos[0].Reader, ShouldEqual, payer2Reader)
+		})
+		Convey("Exact asset of unknown tenant", func() {
+			_, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "payer3", map[string]string{
+					kRegion:        "us-east-1",
+					kAccountNumber: "12345",
+					kInstanceId:    "i-1",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Exact asset no tenant covers", func() {
+			readers.Default = nil
+			_, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "", map[string]string{
+					kRegion:        "us-east-1",
+					kAccountNumber: "12345",
+					kInstanceId:    "i-1",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Several values aren't exact", func() {
+			infos, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "", map[string]string{
+					kRegion:        "us-east-1",
+					kAccountNumber: "12345",
+					kInstanceId:    "i-1|i-9",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldBeNil)
+			So(assetsOf(infos), ShouldResemble, []string{"i-1/"})
+		})
+		Convey("Wildcards match catalog assets", func() {
+			infos, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "", map[string]string{
+					kInstanceId: "*",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldBeNil)
+			So(assetsOf(infos), ShouldResemble, []string{"i-1/", "i-2/", "i-3/"})
+			So(infos[0].Reader, ShouldEqual, defaultReader)
+			// The inventory names the tenant of i-3
+			So(infos[2].Reader, ShouldEqual, payer2Reader)
+		})
+		Convey("Assets seen in queries and in inventory match once", func() {
+			catalog.Observe(
+				&infoType{
+					Asset: tsdbadapter.Asset{
+						Region:        "us-east-1",
+						AccountNumber: "12345",
+						InstanceId:    "i-1",
+					},
+					Name:   "cpu:used",
+					Tenant: "payer2",
+				},
+				nil)
+			infos, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "", map[string]string{
+					kInstanceId: "i-1|i-2",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldBeNil)
+			So(infos, ShouldHaveLength, 2)
+		})
+		Convey("Assets no tenant covers left out", func() {
+			readers.Default = nil
+			infos, err := resolveAssets(
+				newTestQueryInfo("cpu:used", "", map[string]string{
+					kRegion: "*",
+				}),
+				catalog,
+				readers)
+			So(err, ShouldBeNil)
+			So(assetsOf(infos), ShouldResemble, []string{"i-3/"})
+		})
+	})
+}
+
+func TestGroupTimeSeries(t *testing.T) {
+	Convey("With fetched assets", t, func() {
+		infos := []*infoType{
+			newTestInfo("i-1", "cpu:used"),
+			newTestInfo("i-2", "cpu:used"),
+			newTestInfo("i-3", "cpu:used"),
+			newTestInfo("i-4", "cpu:used"),
+		}
+		infos[2].Asset.Region = "us-west-2"
+		fetched := map[*infoType]tsdb.TimeSeries{
+			infos[0]: {{Ts: 100, Value: 1}},
+			infos[1]: {{Ts: 100, Value: 2}},
+			infos[2]: {{Ts: 100, Value: 4}},
+			// CloudHealth doesn't know infos[3]
+		}
+		reducer, err := tsdbadapter.NewReducer("sum", "")
+		So(err, ShouldBeNil)
+		Convey("Group by region", func() {
+			queryInfo := newTestQueryInfo(
+				"cpu:used", "", map[string]string{kRegion: "*"})
+			result := groupTimeSeries(
+				queryInfo, infos, fetched, reducer, 0, 200000)
+			So(result, ShouldHaveLength, 2)
+			So(result[0].Metric, ShouldEqual, "cpu:used")
+			So(result[0].Tags, ShouldResemble, map[string]string{
+				kRegion:        "us-east-1",
+				kAccountNumber: "12345",
+			})
+			So(result[0].AggregateTags, ShouldResemble, []string{kInstanceId})
+			So(
+				result[0].Dps,
+				ShouldResemble,
+				reducer.Reduce(
+					[]tsdb.TimeSeries{fetched[infos[0]], fetched[infos[1]]},
+					0,
+					200000))
+			So(result[1].Tags, ShouldResemble, map[string]string{
+				kRegion:        "us-west-2",
+				kAccountNumber: "12345",
+				kInstanceId:    "i-3",
+			})
+			So(result[1].AggregateTags, ShouldBeEmpty)
+		})
+		Convey("No grouping", func() {
+			queryInfo := newTestQueryInfo(
+				"cpu:used", "payer2", map[string]string{kAccountNumber: "12345"})
+			queryInfo.Filters[0].GroupBy = false
+			result := groupTimeSeries(
+				queryInfo, infos, fetched, reducer, 0, 200000)
+			So(result, ShouldHaveLength, 1)
+			So(result[0].Tags, ShouldResemble, map[string]string{
+				kAccountNumber: "12345",
+				kTenant:        "payer2",
+			})
+			So(
+				result[0].AggregateTags,
+				ShouldResemble,
+				[]string{kRegion, kInstanceId})
+		})
+		Convey("Nothing fetched", func() {
+			queryInfo := newTestQueryInfo(
+				"cpu:used", "", map[string]string{kRegion: "*"})
+			So(
+				groupTimeSeries(
+					queryInfo,
+					infos,
+					map[*infoType]tsdb.TimeSeries{},
+					reducer,
+					0,
+					200000),
+				ShouldBeEmpty)
+		})
+	})
+}
@@ -1,42 +1,139 @@
 package tsdbadapter
 
 import (
+	"context"
 	"fmt"
 	"github.com/Symantec/scotty/tsdb"
+	"github.com/Symantec/scotty/tsdbjson"
 	"github.com/Symantec/uhura/chreader"
+	"sort"
 	"strings"
 	"time"
 )
 
 func fetch(
+	ctx context.Context,
 	reader chreader.Reader,
 	asset *Asset,
 	name string,
 	start,
 	end int64) (tsdb.TimeSeries, error) {
-	fsMetric := strings.HasPrefix(name, "fs:")
-	entries, err := reader.Read(
-		computeAssetId(asset, fsMetric),
+	var result tsdb.TimeSeries
+	err := chreader.ReadIter(
+		ctx,
+		reader,
+		computeAssetId(asset, isFsMetric(name)),
 		millisToTime(start),
-		millisToTime(end))
+		millisToTime(end),
+		func(entry *chreader.Entry) bool {
+			val, ok := entry.Values[name]
+			if ok {
+				result = append(
+					result,
+					tsdb.TsValue{
+						Ts:    float64(entry.Time.Unix()),
+						Value: val,
+					})
+			}
+			return true
+		})
 	if err != nil {
 		return nil, err
 	}
-	var result tsdb.TimeSeries
-	for _, entry := range entries {
-		val, ok := entry.Values[name]
-		if ok {
-			result = append(
-				result,
-				tsdb.TsValue{
-					Ts:    float64(entry.Time.Unix()),
-					Value: val,
-				})
+	return result, nil
+}
+
+func fetchMany(
+	ctx context.Context,
+	reader chreader.Reader,
+	assets []*Asset,
+	name string,
+	start,
+	end int64) ([]tsdb.TimeSeries, []error) {
+	assetIds := make([]string, len(assets))
+	for i := range assets {
+		assetIds[i] = computeAssetId(assets[i], isFsMetric(name))
+	}
+	results := chreader.ReadMany(
+		ctx, reader, assetIds, millisToTime(start), millisToTime(end))
+	series := make([]tsdb.TimeSeries, len(results))
+	errs := make([]error, len(results))
+	for i, result := range results {
+		if result.Err != nil {
+			errs[i] = result.Err
+			continue
+		}
+		for _, entry := range result.Entries {
+			if val, ok := entry.Values[name]; ok {
+				series[i] = append(
+					series[i],
+					tsdb.TsValue{
+						Ts:    float64(entry.Time.Unix()),
+						Value: val,
+					})
+			}
+		}
+	}
+	return series, errs
+}
+
+func describe(
+	ctx context.Context,
+	reader chreader.Reader,
+	asset *Asset,
+	name string) (*MetricInfo, error) {
+	metaData, err := chreader.ReadMetaData(
+		ctx, reader, computeAssetId(asset, isFsMetric(name)))
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range metaData.Metrics() {
+		if metric == name {
+			return &MetricInfo{
+				Granularity: metaData.Granularity,
+				Interval:    metaData.Interval(),
+			}, nil
+		}
+	}
+	return nil, ErrUnknownMetric
+}
+
+func metricNames(
+	ctx context.Context,
+	reader chreader.Reader,
+	asset *Asset) ([]string, error) {
+	names, err := chreader.ReadMetrics(
+		ctx, reader, computeAssetId(asset, false))
+	if err != nil {
+		return nil, err
+	}
+	fsNames, err := chreader.ReadMetrics(
+		ctx, reader, computeAssetId(asset, true))
+	// Not every instance has file system metrics
+	if err != nil && !chreader.IsNotFound(err) {
+		return nil, err
+	}
+	var result []string
+	for _, name := range names {
+		result = append(result, tsdbjson.Escape(name))
+	}
+	for _, name := range fsNames {
+		// Names from the file system asset must be file system metrics
+		// for Fetch to read them from there.
+		if isFsMetric(name) {
+			result = append(result, tsdbjson.Escape(name))
 		}
 	}
+	sort.Strings(result)
 	return result, nil
 }
 
+// isFsMetric returns true if name is a file system metric. File system
+// metrics come from a different CloudHealth asset than the instance.
+func isFsMetric(name string) bool {
+	return strings.HasPrefix(name, "fs:")
+}
+
 func millisToTime(millis int64) time.Time {
 	mils := millis % 1000
 	secs := millis / 1000
@@ -1,11 +1,15 @@
 package tsdbadapter_test
 
 import (
+	"context"
 	"fmt"
 	"github.com/Symantec/scotty/tsdb"
+	"github.com/Symantec/scotty/tsdbjson"
 	"github.com/Symantec/uhura/chreader"
+	"github.com/Symantec/uhura/chreader/chtest"
 	"github.com/Symantec/uhura/tsdbadapter"
 	. "github.com/smartystreets/goconvey/convey"
+	"sort"
 	"testing"
 	"time"
 )
@@ -82,6 +86,22 @@ func (r *fakeReaderType) Read(
 	return result, nil
 }
 
+func (r *fakeReaderType) ReadMetaData(
+	ctx context.Context, assetId string) (*chreader.MetaData, error) {
+	if assetId == r.AssetId {
+		return &chreader.MetaData{
+			Granularity: "hour",
+			Keys:        []string{"assetId", "timestamp", "cpu:even", "cpu:odd"},
+		}, nil
+	} else if assetId == r.FsAssetId {
+		return &chreader.MetaData{
+			Granularity: "day",
+			Keys:        []string{"assetId", "timestamp", "fs:even", "fs:odd"},
+		}, nil
+	}
+	return nil, fmt.Errorf("got unrecognised asset Id '%s'", assetId)
+}
+
 func TestAdapter(t *testing.T) {
 
 	Convey("With fake reader", t, func() {
@@ -223,5 +243,161 @@ func TestAdapter(t *testing.T) {
 			So(fakeReader.FsUseCount, ShouldEqual, 1)
 			So(fakeReader.InstanceUseCount, ShouldEqual, 0)
 		})
+		Convey("Describe known metrics", func() {
+			info, err := tsdbadapter.Describe(
+				context.Background(), fakeReader, &asset, "cpu:odd")
+			So(err, ShouldBeNil)
+			So(info, ShouldResemble, &tsdbadapter.MetricInfo{
+				Granularity: "hour",
+				Interval:    time.Hour,
+			})
+			info, err = tsdbadapter.Describe(
+				context.Background(), fakeReader, &asset, "fs:even")
+			So(err, ShouldBeNil)
+			So(info, ShouldResemble, &tsdbadapter.MetricInfo{
+				Granularity: "day",
+				Interval:    24 * time.Hour,
+			})
+		})
+		Convey("Describe unknown metrics", func() {
+			_, err := tsdbadapter.Describe(
+				context.Background(), fakeReader, &asset, "cpu:none")
+			So(err, ShouldEqual, tsdbadapter.ErrUnknownMetric)
+			_, err = tsdbadapter.Describe(
+				context.Background(), fakeReader, &asset, "fs:none")
+			So(err, ShouldEqual, tsdbadapter.ErrUnknownMetric)
+		})
+		Convey("Metric names", func() {
+			names, err := tsdbadapter.MetricNames(
+				context.Background(), fakeReader, &asset)
+			So(err, ShouldBeNil)
+			expected := []string{
+				tsdbjson.Escape("cpu:even"),
+				tsdbjson.Escape("cpu:odd"),
+				tsdbjson.Escape("fs:even"),
+				tsdbjson.Escape("fs:odd"),
+			}
+			sort.Strings(expected)
+			So(names, ShouldResemble, expected)
+		})
+	})
+}
+
+func TestWithDownsample(t *testing.T) {
+	Convey("Granularity follows downsample interval", t, func() {
+		for downsample, granularity := range map[string]string{
+			"":          "",
+			"1m-avg":    "",
+			"30m-avg":   "",
+			"1h-avg":    "hour",
+			"6h-max":    "",
+			"1d-avg":    "day",
+			"3d-sum":    "",
+			"1d-p95":    "",
+			"1w-avg":    "week",
+			"2w-avg":    "week",
+			"1n-avg":    "day",
+			"1y-avg":    "day",
+			"36h-avg":   "hour",
+			"90m-avg":   "",
+			"0all-avg":  "",
+			"24h-avg-0": "day",
+		} {
+			ctx, err := tsdbadapter.WithDownsample(
+				context.Background(), downsample)
+			So(err, ShouldBeNil)
+			So(
+				chreader.GranularityFromContext(ctx),
+				ShouldEqual,
+				granularity)
+		}
+	})
+	Convey("Max over a day uses hourly values", t, func() {
+		server := chtest.NewServer(chtest.Options{
+			Assets: []string{"arn:aws:ec2:us-east-1:12345:instance/i-1"},
+			Now:    kNow,
+		})
+		defer server.Close()
+		reader := chreader.NewCustomReader(
+			chreader.Config{BaseUrl: server.URL},
+			chreader.DefaultCH,
+			func() time.Time {
+				return kNow
+			})
+		ctx, err := tsdbadapter.WithDownsample(context.Background(), "1d-max")
+		So(err, ShouldBeNil)
+		midnight := kNow.Truncate(24 * time.Hour)
+		start := midnight.Add(-24*time.Hour).Unix() * 1000
+		end := midnight.Unix() * 1000
+		series, err := tsdbadapter.FetchContext(
+			ctx,
+			reader,
+			&tsdbadapter.Asset{
+				Region:        "us-east-1",
+				AccountNumber: "12345",
+				InstanceId:    "i-1",
+			},
+			"cpu:used",
+			start,
+			end)
+		So(err, ShouldBeNil)
+		So(series, ShouldHaveLength, 24)
+		reducer, err := tsdbadapter.NewReducer("max", "1d-max")
+		So(err, ShouldBeNil)
+		So(
+			reducer.Reduce([]tsdb.TimeSeries{series}, start, end),
+			ShouldResemble,
+			tsdb.TimeSeries{{Ts: float64(start / 1000), Value: 23}})
+		for _, request := range server.Requests() {
+			So(request.Query().Get("granularity"), ShouldBeEmpty)
+		}
+	})
+	Convey("Bad downsamples rejected", t, func() {
+		for _, downsample := range []string{"avg", "1x-avg", "0h-avg", "h-avg"} {
+			_, err := tsdbadapter.WithDownsample(
+				context.Background(), downsample)
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestFetchMany(t *testing.T) {
+	Convey("With fake CloudHealth server", t, func() {
+		server := chtest.NewServer(chtest.Options{
+			Assets: []string{
+				"arn:aws:ec2:us-east-1:12345:instance/i-1",
+				"arn:aws:ec2:us-east-1:12345:instance/i-2",
+			},
+			Now: kNow,
+		})
+		defer server.Close()
+		reader := chreader.NewCustomReader(
+			chreader.Config{BaseUrl: server.URL, MaxAssetsPerRequest: 10},
+			chreader.DefaultCH,
+			func() time.Time {
+				return kNow
+			})
+		assets := []*tsdbadapter.Asset{
+			{Region: "us-east-1", AccountNumber: "12345", InstanceId: "i-1"},
+			{Region: "us-east-1", AccountNumber: "12345", InstanceId: "i-3"},
+			{Region: "us-east-1", AccountNumber: "12345", InstanceId: "i-2"},
+		}
+		series, errs := tsdbadapter.FetchMany(
+			context.Background(),
+			reader,
+			assets,
+			"cpu:used",
+			kNowMillis-3*3600*1000,
+			kNowMillis)
+		So(errs[0], ShouldBeNil)
+		So(series[0], ShouldResemble, tsdb.TimeSeries{
+			{Ts: kNowSecs - 3*3600, Value: 13},
+			{Ts: kNowSecs - 2*3600, Value: 14},
+			{Ts: kNowSecs - 3600, Value: 15},
+		})
+		So(chreader.IsNotFound(errs[1]), ShouldBeTrue)
+		So(series[1], ShouldBeNil)
+		So(errs[2], ShouldBeNil)
+		So(series[2], ShouldHaveLength, 3)
 	})
 }
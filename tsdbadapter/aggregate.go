@@ -0,0 +1,298 @@
+package tsdbadapter
+
+import (
+	"fmt"
+	"github.com/Symantec/scotty/tsdb"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// aggregatorFunc reduces values to one. values is never empty.
+type aggregatorFunc func(values []float64) float64
+
+var (
+	kAggregators = map[string]aggregatorFunc{
+		"sum":   sum,
+		"avg":   avg,
+		"min":   minimum,
+		"max":   maximum,
+		"count": count,
+		"dev":   dev,
+		"first": first,
+		"last":  last,
+		"p50":   percentile(50),
+		"p75":   percentile(75),
+		"p90":   percentile(90),
+		"p95":   percentile(95),
+		"p99":   percentile(99),
+		"p999":  percentile(99.9),
+		// Without interpolation, these are the same as their plain
+		// counterparts.
+		"zimsum": sum,
+		"mimmin": minimum,
+		"mimmax": maximum,
+	}
+)
+
+const (
+	kDefaultAggregator = "avg"
+)
+
+// Fill policies for downsample intervals without values
+const (
+	kFillNone = "none"
+	kFillNaN  = "nan"
+	kFillNull = "null"
+	kFillZero = "zero"
+)
+
+func aggregators() []string {
+	result := make([]string, 0, len(kAggregators))
+	for name := range kAggregators {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func aggregatorFor(name string) (aggregatorFunc, error) {
+	result, ok := kAggregators[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown aggregator '%s'", name)
+	}
+	return result, nil
+}
+
+// aggregate combines the values of series at each time with fn. NaN
+// values, which come from filling, are left out unless a time has
+// nothing else, in which case its value is NaN.
+func aggregate(fn aggregatorFunc, series []tsdb.TimeSeries) tsdb.TimeSeries {
+	byTs := make(map[float64][]float64)
+	for _, oneSeries := range series {
+		for _, value := range oneSeries {
+			if math.IsNaN(value.Value) {
+				if _, ok := byTs[value.Ts]; !ok {
+					byTs[value.Ts] = nil
+				}
+				continue
+			}
+			byTs[value.Ts] = append(byTs[value.Ts], value.Value)
+		}
+	}
+	result := make(tsdb.TimeSeries, 0, len(byTs))
+	for ts, values := range byTs {
+		value := math.NaN()
+		if len(values) > 0 {
+			value = fn(values)
+		}
+		result = append(result, tsdb.TsValue{Ts: ts, Value: value})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Ts < result[j].Ts
+	})
+	return result
+}
+
+// downsampleType is a parsed openTSDB downsample specification like
+// "1h-avg" or "1d-max-nan".
+type downsampleType struct {
+	Interval   time.Duration // 0 means the whole time range
+	Aggregator aggregatorFunc
+	Fill       string
+}
+
+func parseDownsample(downsample string) (*downsampleType, error) {
+	interval, err := downsampleInterval(downsample)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(downsample, "-")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, fmt.Errorf("Bad downsample '%s'", downsample)
+	}
+	fn, err := aggregatorFor(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	result := &downsampleType{
+		Interval:   interval,
+		Aggregator: fn,
+		Fill:       kFillNone,
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case kFillNone, kFillNaN, kFillNull, kFillZero:
+			result.Fill = parts[2]
+		default:
+			return nil, fmt.Errorf(
+				"Unknown fill policy '%s' in downsample '%s'",
+				parts[2], downsample)
+		}
+	}
+	return result, nil
+}
+
+// Apply downsamples series, which is sorted by time, for the time range
+// from start to end in seconds since the epoch. Intervals are aligned to
+// multiples of d.Interval since the epoch, and each value has the time
+// of the start of its interval.
+func (d *downsampleType) Apply(
+	series tsdb.TimeSeries, start, end float64) tsdb.TimeSeries {
+	var result tsdb.TimeSeries
+	if d.Interval == 0 {
+		if len(series) > 0 {
+			result = append(result, tsdb.TsValue{
+				Ts:    start,
+				Value: d.Aggregator(values(series)),
+			})
+		}
+		return result
+	}
+	interval := d.Interval.Seconds()
+	bucketStart := math.Floor(start/interval) * interval
+	for bucketStart < end {
+		bucketEnd := bucketStart + interval
+		var bucket tsdb.TimeSeries
+		for len(series) > 0 && series[0].Ts < bucketEnd {
+			if series[0].Ts >= bucketStart {
+				bucket = append(bucket, series[0])
+			}
+			series = series[1:]
+		}
+		if len(bucket) > 0 {
+			result = append(result, tsdb.TsValue{
+				Ts:    bucketStart,
+				Value: d.Aggregator(values(bucket)),
+			})
+		} else if d.Fill != kFillNone {
+			result = append(result, tsdb.TsValue{
+				Ts:    bucketStart,
+				Value: d.fillValue(),
+			})
+		}
+		bucketStart = bucketEnd
+	}
+	return result
+}
+
+func (d *downsampleType) fillValue() float64 {
+	if d.Fill == kFillZero {
+		return 0
+	}
+	return math.NaN()
+}
+
+type reducerType struct {
+	aggregator aggregatorFunc
+	downsample *downsampleType // nil means no downsampling
+}
+
+func newReducer(aggregator, downsample string) (*reducerType, error) {
+	if aggregator == "" {
+		aggregator = kDefaultAggregator
+	}
+	fn, err := aggregatorFor(aggregator)
+	if err != nil {
+		return nil, err
+	}
+	result := &reducerType{aggregator: fn}
+	if downsample != "" {
+		result.downsample, err = parseDownsample(downsample)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Reduce downsamples each of series first and then aggregates them.
+func (r *reducerType) Reduce(
+	series []tsdb.TimeSeries, start, end int64) tsdb.TimeSeries {
+	if r.downsample != nil {
+		downsampled := make([]tsdb.TimeSeries, len(series))
+		for i := range series {
+			downsampled[i] = r.downsample.Apply(
+				series[i], float64(start)/1000.0, float64(end)/1000.0)
+		}
+		series = downsampled
+	}
+	return aggregate(r.aggregator, series)
+}
+
+func values(series tsdb.TimeSeries) []float64 {
+	result := make([]float64, len(series))
+	for i := range series {
+		result[i] = series[i].Value
+	}
+	return result
+}
+
+func sum(values []float64) float64 {
+	var result float64
+	for _, value := range values {
+		result += value
+	}
+	return result
+}
+
+func avg(values []float64) float64 {
+	return sum(values) / float64(len(values))
+}
+
+func minimum(values []float64) float64 {
+	result := values[0]
+	for _, value := range values[1:] {
+		result = math.Min(result, value)
+	}
+	return result
+}
+
+func maximum(values []float64) float64 {
+	result := values[0]
+	for _, value := range values[1:] {
+		result = math.Max(result, value)
+	}
+	return result
+}
+
+func count(values []float64) float64 {
+	return float64(len(values))
+}
+
+// dev returns the sample standard deviation of values.
+func dev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	mean := avg(values)
+	var squares float64
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+	return math.Sqrt(squares / float64(len(values)-1))
+}
+
+func first(values []float64) float64 {
+	return values[0]
+}
+
+func last(values []float64) float64 {
+	return values[len(values)-1]
+}
+
+// percentile returns an aggregator for the pth percentile. It
+// interpolates linearly between the two closest values.
+func percentile(p float64) aggregatorFunc {
+	return func(values []float64) float64 {
+		sorted := make([]float64, len(values))
+		copy(sorted, values)
+		sort.Float64s(sorted)
+		rank := p / 100.0 * float64(len(sorted)-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		fraction := rank - float64(lower)
+		return sorted[lower] + fraction*(sorted[upper]-sorted[lower])
+	}
+}
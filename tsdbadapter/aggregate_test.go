@@ -0,0 +1,138 @@
+package tsdbadapter_test
+
+import (
+	"github.com/Symantec/scotty/tsdb"
+	"github.com/Symantec/uhura/tsdbadapter"
+	. "github.com/smartystreets/goconvey/convey"
+	"math"
+	"testing"
+)
+
+// hourly returns a time series with values every hour starting at
+// kNowSecs.
+func hourly(values ...float64) tsdb.TimeSeries {
+	var result tsdb.TimeSeries
+	for i, value := range values {
+		result = append(result, tsdb.TsValue{
+			Ts:    kNowSecs + float64(i)*3600.0,
+			Value: value,
+		})
+	}
+	return result
+}
+
+func reduce(
+	aggregator, downsample string,
+	hours int,
+	series ...tsdb.TimeSeries) tsdb.TimeSeries {
+	reducer, err := tsdbadapter.NewReducer(aggregator, downsample)
+	So(err, ShouldBeNil)
+	return reducer.Reduce(
+		series, kNowMillis, kNowMillis+int64(hours)*3600*1000)
+}
+
+func TestReducer(t *testing.T) {
+	Convey("Aggregators", t, func() {
+		aggregators := tsdbadapter.Aggregators()
+		for _, name := range []string{
+			"sum", "avg", "min", "max", "count", "dev", "p50", "p99"} {
+			So(aggregators, ShouldContain, name)
+		}
+	})
+	Convey("Bad aggregators and downsamples rejected", t, func() {
+		for _, args := range [][2]string{
+			{"median", ""},
+			{"avg", "1h"},
+			{"avg", "1h-median"},
+			{"avg", "1h-avg-some"},
+			{"avg", "1x-avg"},
+		} {
+			_, err := tsdbadapter.NewReducer(args[0], args[1])
+			So(err, ShouldNotBeNil)
+		}
+	})
+	Convey("Single series without downsample", t, func() {
+		series := hourly(1, 2, 3)
+		So(reduce("sum", "", 3, series), ShouldResemble, series)
+		So(reduce("max", "", 3, series), ShouldResemble, series)
+		So(reduce("count", "", 3, series), ShouldResemble, hourly(1, 1, 1))
+		So(reduce("dev", "", 3, series), ShouldResemble, hourly(0, 0, 0))
+	})
+	Convey("Downsample", t, func() {
+		series := hourly(1, 2, 3, 4, 5)
+		Convey("Sum", func() {
+			So(
+				reduce("avg", "2h-sum", 5, series),
+				ShouldResemble,
+				tsdb.TimeSeries{
+					{Ts: kNowSecs, Value: 3},
+					{Ts: kNowSecs + 7200, Value: 7},
+					{Ts: kNowSecs + 14400, Value: 5},
+				})
+		})
+		Convey("All", func() {
+			So(
+				reduce("avg", "0all-max", 5, series),
+				ShouldResemble,
+				tsdb.TimeSeries{{Ts: kNowSecs, Value: 5}})
+		})
+		Convey("Percentile", func() {
+			So(
+				reduce("avg", "4h-p50", 4, series),
+				ShouldResemble,
+				tsdb.TimeSeries{{Ts: kNowSecs, Value: 2.5}})
+		})
+		Convey("Fill", func() {
+			gappy := tsdb.TimeSeries{series[0], series[2]}
+			So(
+				reduce("avg", "1h-avg", 3, gappy),
+				ShouldResemble,
+				tsdb.TimeSeries{series[0], series[2]})
+			So(
+				reduce("avg", "1h-avg-zero", 3, gappy),
+				ShouldResemble,
+				tsdb.TimeSeries{
+					series[0],
+					{Ts: kNowSecs + 3600, Value: 0},
+					series[2],
+				})
+			filled := reduce("avg", "1h-avg-nan", 3, gappy)
+			So(filled, ShouldHaveLength, 3)
+			So(math.IsNaN(filled[1].Value), ShouldBeTrue)
+		})
+	})
+	Convey("Aggregate", t, func() {
+		series := []tsdb.TimeSeries{
+			hourly(2, 4, 4, 4),
+			hourly(4, 6, 5, 5, 7, 9),
+		}
+		So(
+			reduce("sum", "", 6, series...),
+			ShouldResemble,
+			hourly(6, 10, 9, 9, 7, 9))
+		So(
+			reduce("count", "", 6, series...),
+			ShouldResemble,
+			hourly(2, 2, 2, 2, 1, 1))
+		deviation := reduce("dev", "0all-avg", 6, series...)
+		So(deviation, ShouldHaveLength, 1)
+		// Averages are 3.5 and 6
+		So(deviation[0].Value, ShouldAlmostEqual, 2.5/math.Sqrt2)
+	})
+	Convey("Aggregate keeps fill", t, func() {
+		series := []tsdb.TimeSeries{
+			{hourly(1, 2, 3)[0], hourly(1, 2, 3)[2]},
+			hourly(2),
+		}
+		filled := reduce("sum", "1h-sum-nan", 3, series...)
+		So(filled, ShouldHaveLength, 3)
+		So(filled[0], ShouldResemble, tsdb.TsValue{Ts: kNowSecs, Value: 3})
+		So(filled[1].Ts, ShouldEqual, kNowSecs+3600)
+		So(math.IsNaN(filled[1].Value), ShouldBeTrue)
+		So(filled[2], ShouldResemble, tsdb.TsValue{Ts: kNowSecs + 7200, Value: 3})
+		So(
+			reduce("sum", "1h-sum-zero", 3, series...),
+			ShouldResemble,
+			hourly(3, 0, 3))
+	})
+}
@@ -2,8 +2,17 @@
 package tsdbadapter
 
 import (
+	"context"
+	"errors"
 	"github.com/Symantec/scotty/tsdb"
 	"github.com/Symantec/uhura/chreader"
+	"time"
+)
+
+var (
+	// ErrUnknownMetric means that CloudHealth does not have the requested
+	// metric for an asset.
+	ErrUnknownMetric = errors.New("tsdbadapter: Unknown metric")
 )
 
 // An Asset represents a specific machine in an AWS fleet
@@ -26,9 +35,123 @@ func Fetch(
 	start,
 	end int64) (tsdb.TimeSeries, error) {
 	return fetch(
+		context.Background(),
+		reader,
+		asset,
+		name,
+		start,
+		end)
+}
+
+// FetchContext works like Fetch except that it gives up as soon as ctx is
+// done.
+func FetchContext(
+	ctx context.Context,
+	reader chreader.Reader,
+	asset *Asset,
+	name string,
+	start,
+	end int64) (tsdb.TimeSeries, error) {
+	return fetch(
+		ctx,
 		reader,
 		asset,
 		name,
 		start,
 		end)
 }
+
+// FetchMany works like FetchContext for several assets at once. When
+// reader implements chreader.BatchReader, FetchMany reads the assets
+// together. The returned time series and errors are in the same order
+// as assets. An asset either has a time series or an error.
+func FetchMany(
+	ctx context.Context,
+	reader chreader.Reader,
+	assets []*Asset,
+	name string,
+	start,
+	end int64) ([]tsdb.TimeSeries, []error) {
+	return fetchMany(ctx, reader, assets, name, start, end)
+}
+
+// MetricInfo describes a single metric of an asset.
+type MetricInfo struct {
+	// How often CloudHealth has values like "hour" or "day"
+	Granularity string
+	// The time between values like time.Hour. 0 if not known.
+	Interval time.Duration
+}
+
+// Describe returns information about the named metric of asset.
+// Describe returns ErrUnknownMetric if CloudHealth does not have that
+// metric for asset. Describe returns chreader.ErrNoMetaData if CloudHealth
+// has no metadata for asset and chreader.ErrMetaDataNotSupported if reader
+// cannot report metadata.
+func Describe(
+	ctx context.Context,
+	reader chreader.Reader,
+	asset *Asset,
+	name string) (*MetricInfo, error) {
+	return describe(ctx, reader, asset, name)
+}
+
+// MetricNames returns the sorted openTSDB names of the metrics CloudHealth
+// has for asset including those of its file systems. Clients pass
+// tsdbjson.Unescape of a returned name to Fetch. MetricNames returns
+// chreader.ErrMetaDataNotSupported if reader cannot report metadata.
+// Clients that want the names cached pass a reader from
+// chreader.NewCachingReader.
+func MetricNames(
+	ctx context.Context,
+	reader chreader.Reader,
+	asset *Asset) ([]string, error) {
+	return metricNames(ctx, reader, asset)
+}
+
+// Aggregators returns the sorted names of the openTSDB aggregators that
+// NewReducer supports.
+func Aggregators() []string {
+	return aggregators()
+}
+
+// Reducer downsamples and aggregates the time series of one openTSDB
+// query.
+type Reducer struct {
+	reducer *reducerType
+}
+
+// NewReducer returns a Reducer for an openTSDB aggregator like "sum" or
+// "p95" and downsample specification like "1h-avg" or "1d-max-nan".
+// An empty aggregator means "avg"; an empty downsample means no
+// downsampling. Fill policies "nan" and "null" both fill with NaN.
+func NewReducer(aggregator, downsample string) (*Reducer, error) {
+	reducer, err := newReducer(aggregator, downsample)
+	if err != nil {
+		return nil, err
+	}
+	return &Reducer{reducer: reducer}, nil
+}
+
+// Reduce downsamples each of series for the time range from start to end
+// in milliseconds since the epoch and then aggregates them into one.
+// Downsample intervals are aligned to multiples of the interval since the
+// epoch. Aggregating combines the values at each time; it does not
+// interpolate.
+func (r *Reducer) Reduce(
+	series []tsdb.TimeSeries, start, end int64) tsdb.TimeSeries {
+	return r.reducer.Reduce(series, start, end)
+}
+
+// WithDownsample returns a copy of ctx that asks for the coarsest
+// CloudHealth granularity having values at least as often as downsample,
+// an openTSDB downsample specification like "1h-avg". Intervals shorter
+// than an hour and "0all" leave the granularity up to the reader since
+// minute values are costly to fetch. Since CloudHealth averages the values
+// of coarser granularities, only "avg" downsamples change the granularity.
+// Others like "1d-max" leave ctx as is. An empty downsample leaves ctx as
+// is.
+func WithDownsample(ctx context.Context, downsample string) (
+	context.Context, error) {
+	return withDownsample(ctx, downsample)
+}
@@ -0,0 +1,105 @@
+package tsdbadapter
+
+import (
+	"context"
+	"fmt"
+	"github.com/Symantec/uhura/chreader"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	kDownsampleUnits = map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"n":  30 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+)
+
+// kAveragingDownsamplers are the downsamplers whose result stays the same
+// when the values come from CloudHealth already averaged over each
+// interval of a coarser granularity.
+var (
+	kAveragingDownsamplers = map[string]bool{
+		"avg": true,
+	}
+)
+
+// kGranularities goes from coarsest to finest.
+var (
+	kGranularities = []struct {
+		Name     string
+		Interval time.Duration
+	}{
+		{Name: "week", Interval: 7 * 24 * time.Hour},
+		{Name: "day", Interval: 24 * time.Hour},
+		{Name: "hour", Interval: time.Hour},
+	}
+)
+
+// downsampleInterval returns the interval of an openTSDB downsample
+// specification like "1h-avg". downsampleInterval returns 0 for
+// "0all-avg" which means one value for the whole time range.
+func downsampleInterval(downsample string) (time.Duration, error) {
+	intervalStr := strings.SplitN(downsample, "-", 2)[0]
+	if strings.HasSuffix(intervalStr, "all") {
+		return 0, nil
+	}
+	unitIdx := strings.IndexFunc(intervalStr, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	if unitIdx <= 0 {
+		return 0, fmt.Errorf("Bad downsample '%s'", downsample)
+	}
+	count, err := strconv.Atoi(intervalStr[:unitIdx])
+	if err != nil {
+		return 0, fmt.Errorf("Bad downsample '%s'", downsample)
+	}
+	unit, ok := kDownsampleUnits[intervalStr[unitIdx:]]
+	if !ok || count <= 0 {
+		return 0, fmt.Errorf("Bad downsample '%s'", downsample)
+	}
+	return time.Duration(count) * unit, nil
+}
+
+// granularityFor returns the coarsest CloudHealth granularity that evenly
+// divides interval or the empty string if none does. Downsample intervals
+// start at multiples of interval since the epoch, so each one then covers
+// whole intervals of the granularity. Months and years count as 30 and
+// 365 days, which weeks don't divide.
+func granularityFor(interval time.Duration) string {
+	for _, granularity := range kGranularities {
+		if interval > 0 && interval%granularity.Interval == 0 {
+			return granularity.Name
+		}
+	}
+	return ""
+}
+
+func withDownsample(ctx context.Context, downsample string) (
+	context.Context, error) {
+	if downsample == "" {
+		return ctx, nil
+	}
+	interval, err := downsampleInterval(downsample)
+	if err != nil {
+		return nil, err
+	}
+	// CloudHealth averages values for coarser granularities so that
+	// max, sum, percentiles, etc. need the finer values.
+	parts := strings.Split(downsample, "-")
+	if len(parts) < 2 || !kAveragingDownsamplers[parts[1]] {
+		return ctx, nil
+	}
+	granularity := granularityFor(interval)
+	if granularity == "" {
+		return ctx, nil
+	}
+	return chreader.WithGranularity(ctx, granularity), nil
+}